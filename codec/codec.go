@@ -0,0 +1,89 @@
+// Package codec serializes session values for the persistent providers.
+//
+// every payload is wrapped in a small envelope recording the codec that encoded it
+// and the schema version of the values, so that payloads written by different codecs
+// can be decoded side by side while switching from one codec to another, and values
+// written by older versions of the application are upgraded when they are read.
+package codec
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Codec encodes session values to bytes and back.
+type Codec interface {
+	ID() byte     // written in the payload header, it must be unique and never change
+	Name() string // used to select the codec by config
+	Encode(values map[interface{}]interface{}) ([]byte, error)
+	Decode(data []byte) (map[interface{}]interface{}, error)
+}
+
+var (
+	// Gob encodes values with encoding/gob, custom types must be registered by gob.Register
+	Gob Codec = gobCodec{}
+	// JSON encodes values with encoding/json, keys must be strings
+	// and numbers are decoded as float64
+	JSON Codec = jsonCodec{}
+	// MsgPack encodes values with MessagePack
+	MsgPack Codec = msgpackCodec{}
+)
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[byte]Codec)
+)
+
+func init() {
+	Register(Gob)
+	Register(JSON)
+	Register(MsgPack)
+}
+
+// Register makes a codec available for decoding and for Lookup by name.
+// If Register is called twice with the same id or if c is nil, it panics.
+func Register(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if c == nil {
+		panic("codec: Register codec is nil")
+	}
+	if _, dup := codecs[c.ID()]; dup {
+		panic(fmt.Sprintf("codec: Register called twice for codec id %d", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+// Lookup find a registered codec by its name.
+func Lookup(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("codec: unknown codec %q", name)
+}
+
+func byID(id byte) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown codec id %d", id)
+	}
+	return c, nil
+}
+
+// Marshal encode values by c and wrap them in the payload envelope, c defaults to Gob.
+func Marshal(c Codec, values map[interface{}]interface{}) ([]byte, error) {
+	return (&Serializer{Codec: c}).Marshal(values)
+}
+
+// Unmarshal decode an unencrypted payload written by Marshal with whichever codec it records,
+// values of an older schema version are upgraded by the registered migrations.
+func Unmarshal(data []byte) (map[interface{}]interface{}, error) {
+	values, _, err := (&Serializer{}).Unmarshal(data)
+	return values, err
+}
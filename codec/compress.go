@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// DefaultCompressThreshold is the body size, in bytes, from which a Serializer
+// with a Compressor compresses the payload when CompressThreshold is zero.
+const DefaultCompressThreshold = 1024
+
+// Compressor compresses encoded session values before they are stored.
+type Compressor interface {
+	ID() byte     // written in the payload header, it must be unique and never change
+	Name() string // used to select the compressor by config
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Gzip compresses payloads with compress/gzip at the default level
+var Gzip Compressor = gzipCompressor{}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = make(map[byte]Compressor)
+)
+
+func init() {
+	RegisterCompressor(Gzip)
+}
+
+// RegisterCompressor makes a compressor available for decompressing and for LookupCompressor by name,
+// such as a snappy one.
+// If RegisterCompressor is called twice with the same id or if c is nil, it panics.
+func RegisterCompressor(c Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	if c == nil {
+		panic("codec: RegisterCompressor compressor is nil")
+	}
+	if _, dup := compressors[c.ID()]; dup {
+		panic(fmt.Sprintf("codec: RegisterCompressor called twice for compressor id %d", c.ID()))
+	}
+	compressors[c.ID()] = c
+}
+
+// LookupCompressor find a registered compressor by its name.
+func LookupCompressor(name string) (Compressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	for _, c := range compressors {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("codec: unknown compressor %q", name)
+}
+
+func compressorByID(id byte) (Compressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	c, ok := compressors[id]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown compressor id %d", id)
+	}
+	return c, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() byte {
+	return 1
+}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"github.com/misu99/session/utils"
+)
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return 1
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	return utils.EncodeGob(values)
+}
+
+func (gobCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	return utils.DecodeGob(data)
+}
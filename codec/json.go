@@ -0,0 +1,40 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return 2
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("codec: json key must be a string, got %T", k)
+		}
+		m[key] = v
+	}
+	return json.Marshal(m)
+}
+
+func (jsonCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+	return values, nil
+}
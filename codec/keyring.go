@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Keyring holds the AES-GCM keys encrypting payloads by their one byte id.
+// the primary key encrypts new payloads, every key can decrypt, so that
+// a key can be rotated while payloads sealed by the old one are still readable.
+type Keyring struct {
+	lock    sync.RWMutex
+	primary byte
+	aeads   map[byte]cipher.AEAD
+}
+
+// NewKeyring create a keyring with the primary key, key must be 16, 24 or 32 bytes
+// to select AES-128, AES-192 or AES-256.
+func NewKeyring(id byte, key []byte) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[byte]cipher.AEAD)}
+	if err := k.Add(id, key); err != nil {
+		return nil, err
+	}
+	k.primary = id
+	return k, nil
+}
+
+// Add add a key which only decrypts, such as the previous primary key.
+func (k *Keyring) Add(id byte, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, dup := k.aeads[id]; dup {
+		return fmt.Errorf("codec: key id %d already exists", id)
+	}
+	k.aeads[id] = aead
+	return nil
+}
+
+// Rotate add a new key and make it the primary key, the old keys are kept for decryption.
+func (k *Keyring) Rotate(id byte, key []byte) error {
+	if err := k.Add(id, key); err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.primary = id
+	return nil
+}
+
+// Remove remove a key once no payload is sealed by it any more, the primary key can not be removed.
+func (k *Keyring) Remove(id byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if id == k.primary {
+		return errors.New("codec: can not remove the primary key")
+	}
+	delete(k.aeads, id)
+	return nil
+}
+
+// Primary returns the id of the primary key.
+func (k *Keyring) Primary() byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.primary
+}
+
+// Seal encrypt and authenticate plaintext and additional data by the key id,
+// the random nonce and the ciphertext are appended to dst.
+func (k *Keyring) Seal(dst []byte, id byte, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypt and authenticate the output of Seal by the key id.
+func (k *Keyring) Open(id byte, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("codec: sealed payload is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func (k *Keyring) aead(id byte) (cipher.AEAD, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown key id %d", id)
+	}
+	return aead, nil
+}
@@ -0,0 +1,45 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyringRotate(t *testing.T) {
+	k := testKeyring(t)
+	sealed, err := k.Seal(nil, k.Primary(), []byte("values"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Rotate(2, bytes.Repeat([]byte("b"), 32)); err != nil {
+		t.Fatal(err)
+	}
+	if k.Primary() != 2 {
+		t.Fatalf("Primary = %d after Rotate, want 2", k.Primary())
+	}
+	if b, err := k.Open(1, sealed, []byte("ad")); err != nil || string(b) != "values" {
+		t.Errorf("old key: Open = %q, %v", b, err)
+	}
+	if _, err := k.Open(1, sealed, []byte("other")); err == nil {
+		t.Error("Open accepted another additional data")
+	}
+	if err := k.Remove(2); err == nil {
+		t.Error("the primary key is removed")
+	}
+	if err := k.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Open(1, sealed, []byte("ad")); err == nil {
+		t.Error("Open by a removed key")
+	}
+}
+
+func TestKeyringRejectsBadKeys(t *testing.T) {
+	if _, err := NewKeyring(1, []byte("short")); err == nil {
+		t.Error("NewKeyring accepted a 5 bytes key")
+	}
+	k := testKeyring(t)
+	if err := k.Add(1, bytes.Repeat([]byte("c"), 16)); err == nil {
+		t.Error("Add accepted a duplicate key id")
+	}
+}
@@ -0,0 +1,30 @@
+package codec
+
+import (
+	"github.com/vmihailenco/msgpack"
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() byte {
+	return 3
+}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Encode(values map[interface{}]interface{}) ([]byte, error) {
+	return msgpack.Marshal(values)
+}
+
+func (msgpackCodec) Decode(data []byte) (map[interface{}]interface{}, error) {
+	var values map[interface{}]interface{}
+	if err := msgpack.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[interface{}]interface{})
+	}
+	return values, nil
+}
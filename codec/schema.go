@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Migration upgrades session values from one schema version to the next.
+type Migration func(values map[interface{}]interface{}) (map[interface{}]interface{}, error)
+
+// Schema holds the schema version stamped on written payloads and the
+// migrations upgrading payloads of older versions.
+type Schema struct {
+	lock       sync.RWMutex
+	version    uint64
+	migrations map[uint64]Migration
+}
+
+// DefaultSchema is the schema used by Marshal and Unmarshal.
+var DefaultSchema = NewSchema()
+
+// NewSchema create a schema at version 0 without migrations.
+func NewSchema() *Schema {
+	return &Schema{migrations: make(map[uint64]Migration)}
+}
+
+// SetSchemaVersion set the version of DefaultSchema, see Schema.SetVersion.
+func SetSchemaVersion(version uint64) {
+	DefaultSchema.SetVersion(version)
+}
+
+// RegisterMigration register a migration on DefaultSchema, see Schema.Register.
+func RegisterMigration(from uint64, m Migration) {
+	DefaultSchema.Register(from, m)
+}
+
+// Version returns the current schema version.
+func (s *Schema) Version() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.version
+}
+
+// SetVersion set the current schema version, payloads are written with it from now on.
+// payloads of an older version need a migration for every version in between.
+func (s *Schema) SetVersion(version uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version = version
+}
+
+// Register add the migration upgrading values of version from to version from+1.
+// If Register is called twice with the same version or if m is nil, it panics.
+func (s *Schema) Register(from uint64, m Migration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if m == nil {
+		panic("codec: Register migration is nil")
+	}
+	if _, dup := s.migrations[from]; dup {
+		panic(fmt.Sprintf("codec: Register called twice for migration from version %d", from))
+	}
+	s.migrations[from] = m
+}
+
+// Migrate upgrade values of version to the current version.
+// values of a newer version, written by a newer deployment, are returned as is.
+func (s *Schema) Migrate(version uint64, values map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for ; version < s.version; version++ {
+		m, ok := s.migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("codec: no migration from schema version %d", version)
+		}
+		var err error
+		if values, err = m(values); err != nil {
+			return nil, fmt.Errorf("codec: migration from schema version %d: %v", version, err)
+		}
+	}
+	return values, nil
+}
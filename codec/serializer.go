@@ -0,0 +1,217 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/misu99/session/store"
+)
+
+// payload envelope:
+//
+//	formatV1: magic, format, codec id, body
+//	formatV2: magic, format, codec id, uvarint schema version, body
+//	formatV3: magic, format, flags, codec id, uvarint schema version, [compressor id], [key id], body
+//
+// a gob stream never starts with a zero byte, so payloads written before
+// the envelope existed are told apart and decoded by Gob as schema version 0.
+// with flagCompressed the encoded values are compressed by the compressor id,
+// with flagEncrypted the body is then sealed by the key id, the header is authenticated with it.
+const (
+	magic    = 0x00
+	formatV1 = 1
+	formatV2 = 2
+	formatV3 = 3
+
+	flagEncrypted  = 1 << 0
+	flagCompressed = 1 << 1
+)
+
+// SchemaVersionKey holds the schema version of values decoded from a payload of a newer
+// version than DefaultSchema, written by a newer deployment. Marshal writes them with that
+// version again rather than stamping the older current one over them, it is not encoded.
+const SchemaVersionKey = store.MetadataPrefix + "schema_version"
+
+// Serializer turns session values into stored payloads and back.
+// the zero value encodes by Gob without compression nor encryption.
+type Serializer struct {
+	Codec             Codec      // codec of new payloads, defaults to Gob
+	Compressor        Compressor // compresses new payloads if not nil
+	CompressThreshold int        // encoded values shorter than it are stored raw, defaults to DefaultCompressThreshold
+	Keyring           *Keyring   // encrypts new payloads and decrypts stored ones if not nil
+}
+
+// Marshal encode values and wrap them in the payload envelope.
+func (s *Serializer) Marshal(values map[interface{}]interface{}) ([]byte, error) {
+	version := DefaultSchema.Version()
+	if v, ok := values[SchemaVersionKey]; ok {
+		if newer, ok := v.(uint64); ok && newer > version {
+			version = newer
+		}
+		kept := make(map[interface{}]interface{}, len(values))
+		for k, v := range values {
+			if k != SchemaVersionKey {
+				kept[k] = v
+			}
+		}
+		values = kept
+	}
+
+	c := s.codec()
+	body, err := c.Encode(values)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	var compressorID byte
+	if s.Compressor != nil && len(body) >= s.compressThreshold() {
+		flags |= flagCompressed
+		compressorID = s.Compressor.ID()
+		if body, err = s.Compressor.Compress(body); err != nil {
+			return nil, err
+		}
+	}
+	if s.Keyring != nil {
+		flags |= flagEncrypted
+	}
+
+	b := make([]byte, 0, 6+binary.MaxVarintLen64+len(body))
+	if flags == 0 {
+		b = append(b, magic, formatV2, c.ID())
+		b = appendUvarint(b, version)
+		return append(b, body...), nil
+	}
+
+	b = append(b, magic, formatV3, flags, c.ID())
+	b = appendUvarint(b, version)
+	if flags&flagCompressed != 0 {
+		b = append(b, compressorID)
+	}
+	if flags&flagEncrypted == 0 {
+		return append(b, body...), nil
+	}
+	keyID := s.Keyring.Primary()
+	b = append(b, keyID)
+	return s.Keyring.Seal(b, keyID, body, b)
+}
+
+// Unmarshal decode a payload with whichever codec it records, values of an older
+// schema version are upgraded by the registered migrations.
+// stale reports whether the payload differs from what Marshal writes now, by codec,
+// older schema version or encryption key, so that it should be written again.
+// the values of a newer schema version carry it under SchemaVersionKey.
+// compression does not make a payload stale, it depends on the size of the values.
+func (s *Serializer) Unmarshal(data []byte) (values map[interface{}]interface{}, stale bool, err error) {
+	if len(data) == 0 || data[0] != magic {
+		if values, err = Gob.Decode(data); err != nil {
+			return nil, false, err
+		}
+		values, err = DefaultSchema.Migrate(0, values)
+		return values, true, err
+	}
+	if len(data) < 3 {
+		return nil, false, errors.New("codec: payload header is truncated")
+	}
+
+	var flags byte
+	var version uint64
+	format := data[1]
+	rest := data[2:]
+	if format == formatV3 {
+		flags, rest = rest[0], rest[1:]
+		if flags&^(flagEncrypted|flagCompressed) != 0 {
+			return nil, false, fmt.Errorf("codec: unknown payload flags %#x", flags)
+		}
+		if len(rest) == 0 {
+			return nil, false, errors.New("codec: payload header is truncated")
+		}
+	}
+	c, err := byID(rest[0])
+	if err != nil {
+		return nil, false, err
+	}
+	rest = rest[1:]
+
+	switch format {
+	case formatV1:
+	case formatV2, formatV3:
+		var n int
+		version, n = binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, false, errors.New("codec: payload schema version is malformed")
+		}
+		rest = rest[n:]
+	default:
+		return nil, false, fmt.Errorf("codec: unknown payload format %d", format)
+	}
+
+	var compressor Compressor
+	if flags&flagCompressed != 0 {
+		if len(rest) == 0 {
+			return nil, false, errors.New("codec: payload compressor id is missing")
+		}
+		if compressor, err = compressorByID(rest[0]); err != nil {
+			return nil, false, err
+		}
+		rest = rest[1:]
+	}
+
+	encrypted := flags&flagEncrypted != 0
+	current := DefaultSchema.Version()
+	stale = c.ID() != s.codec().ID() || version < current || encrypted != (s.Keyring != nil)
+	body := rest
+	if encrypted {
+		if s.Keyring == nil {
+			return nil, false, errors.New("codec: payload is encrypted but there is no keyring")
+		}
+		if len(rest) == 0 {
+			return nil, false, errors.New("codec: payload key id is missing")
+		}
+		keyID := rest[0]
+		header := data[:len(data)-len(rest)+1]
+		if body, err = s.Keyring.Open(keyID, rest[1:], header); err != nil {
+			return nil, false, err
+		}
+		stale = stale || keyID != s.Keyring.Primary()
+	}
+
+	if compressor != nil {
+		if body, err = compressor.Decompress(body); err != nil {
+			return nil, false, err
+		}
+	}
+	if values, err = c.Decode(body); err != nil {
+		return nil, false, err
+	}
+	if values, err = DefaultSchema.Migrate(version, values); err != nil {
+		return nil, false, err
+	}
+	if version > current {
+		if values == nil {
+			values = make(map[interface{}]interface{})
+		}
+		values[SchemaVersionKey] = version
+	}
+	return values, stale, nil
+}
+
+func (s *Serializer) codec() Codec {
+	if s.Codec == nil {
+		return Gob
+	}
+	return s.Codec
+}
+
+func (s *Serializer) compressThreshold() int {
+	if s.CompressThreshold == 0 {
+		return DefaultCompressThreshold
+	}
+	return s.CompressThreshold
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
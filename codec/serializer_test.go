@@ -0,0 +1,133 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	k, err := NewKeyring(1, bytes.Repeat([]byte("a"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSerializerRoundTrip(t *testing.T) {
+	serializers := map[string]*Serializer{
+		"gob":        {},
+		"json":       {Codec: JSON},
+		"msgpack":    {Codec: MsgPack},
+		"compressed": {Compressor: Gzip, CompressThreshold: 1},
+		"encrypted":  {Keyring: testKeyring(t)},
+		"both":       {Codec: JSON, Compressor: Gzip, CompressThreshold: 1, Keyring: testKeyring(t)},
+	}
+	for name, s := range serializers {
+		b, err := s.Marshal(map[interface{}]interface{}{"user": "alice", "note": strings.Repeat("x", 100)})
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", name, err)
+		}
+		values, stale, err := s.Unmarshal(b)
+		if err != nil {
+			t.Fatalf("%s: Unmarshal: %v", name, err)
+		}
+		if stale {
+			t.Errorf("%s: a payload just written is stale", name)
+		}
+		if values["user"] != "alice" || len(values) != 2 {
+			t.Errorf("%s: values = %v", name, values)
+		}
+	}
+}
+
+func TestSerializerTampered(t *testing.T) {
+	s := &Serializer{Keyring: testKeyring(t)}
+	b, err := s.Marshal(map[interface{}]interface{}{"user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range b {
+		tampered := append([]byte(nil), b...)
+		tampered[i] ^= 0x01
+		if values, _, err := s.Unmarshal(tampered); err == nil {
+			t.Errorf("byte %d flipped: decoded %v", i, values)
+		}
+	}
+	if _, _, err := (&Serializer{}).Unmarshal(b); err == nil {
+		t.Error("an encrypted payload is decoded without a keyring")
+	}
+}
+
+func TestSerializerStale(t *testing.T) {
+	plain := &Serializer{}
+	b, err := plain.Marshal(map[interface{}]interface{}{"user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*Serializer{
+		"codec":   {Codec: JSON},
+		"keyring": {Keyring: testKeyring(t)},
+	} {
+		if _, stale, err := s.Unmarshal(b); err != nil || !stale {
+			t.Errorf("%s: stale = %v, err = %v", name, stale, err)
+		}
+	}
+
+	k := testKeyring(t)
+	sealed, err := (&Serializer{Keyring: k}).Marshal(map[interface{}]interface{}{"user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Rotate(2, bytes.Repeat([]byte("b"), 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, stale, err := (&Serializer{Keyring: k}).Unmarshal(sealed); err != nil || !stale {
+		t.Errorf("old key: stale = %v, err = %v", stale, err)
+	}
+}
+
+func TestSerializerSchemaVersions(t *testing.T) {
+	schema := DefaultSchema
+	DefaultSchema = NewSchema()
+	defer func() { DefaultSchema = schema }()
+	RegisterMigration(0, func(values map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+		values["migrated"] = true
+		return values, nil
+	})
+	s := &Serializer{}
+
+	old, err := s.Marshal(map[interface{}]interface{}{"user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSchemaVersion(2)
+	newer, err := s.Marshal(map[interface{}]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSchemaVersion(1)
+
+	values, stale, err := s.Unmarshal(old)
+	if err != nil || !stale || values["migrated"] != true {
+		t.Errorf("older version: values %v, stale %v, err %v", values, stale, err)
+	}
+
+	values, stale, err = s.Unmarshal(newer)
+	if err != nil || stale {
+		t.Fatalf("newer version: stale %v, err %v", stale, err)
+	}
+	values["user"] = "carol"
+	b, err := s.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSchemaVersion(2)
+	values, stale, err = s.Unmarshal(b)
+	if err != nil || stale {
+		t.Fatalf("newer version written again: stale %v, err %v", stale, err)
+	}
+	if values["user"] != "carol" || len(values) != 1 {
+		t.Errorf("newer version written again: values %v", values)
+	}
+}
@@ -0,0 +1,150 @@
+package session
+
+import (
+	"fmt"
+	"github.com/misu99/session/codec"
+	"net/textproto"
+	"strings"
+)
+
+// MinSessionIDLength is the minimal number of random bytes in a session id,
+// shorter ids do not carry enough entropy to resist guessing.
+const MinSessionIDLength = 8
+
+// ConfigError lists every problem found in a ManagerConfig.
+type ConfigError struct {
+	Problems []string
+}
+
+// Error implement the error interface
+func (e *ConfigError) Error() string {
+	return "session: invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate check the config and return a *ConfigError listing every problem,
+// or nil if the config is usable.
+// zero Maxlifetime and SessionIDLength are valid and replaced by their defaults in NewManager.
+func (cf *ManagerConfig) Validate() error {
+	e := &ConfigError{}
+
+	if cf.CookieName == "" {
+		e.add("CookieName is empty")
+	}
+	if cf.Gclifetime <= 0 {
+		e.add("Gclifetime must be positive, got %d", cf.Gclifetime)
+	}
+	if cf.Maxlifetime < 0 {
+		e.add("Maxlifetime must not be negative, got %d", cf.Maxlifetime)
+	}
+	if cf.CookieLifeTime < 0 {
+		e.add("CookieLifeTime must not be negative, got %d", cf.CookieLifeTime)
+	}
+	if cf.IdleTimeout < 0 {
+		e.add("IdleTimeout must not be negative, got %d", cf.IdleTimeout)
+	}
+	if cf.AbsoluteTimeout < 0 {
+		e.add("AbsoluteTimeout must not be negative, got %d", cf.AbsoluteTimeout)
+	}
+	if cf.RefreshFraction < 0 || cf.RefreshFraction >= 1 {
+		e.add("RefreshFraction must be in [0, 1), got %v", cf.RefreshFraction)
+	}
+	if cf.SessionIDLength < 0 || (cf.SessionIDLength > 0 && cf.SessionIDLength < MinSessionIDLength) {
+		e.add("SessionIDLength must be at least %d bytes to be safe, got %d", MinSessionIDLength, cf.SessionIDLength)
+	}
+
+	if cf.Codec != "" {
+		if _, err := codec.Lookup(cf.Codec); err != nil {
+			e.add("Codec %s is not registered", cf.Codec)
+		}
+	}
+
+	if cf.Compression != "" {
+		if _, err := codec.LookupCompressor(cf.Compression); err != nil {
+			e.add("Compression %s is not registered", cf.Compression)
+		}
+	}
+	if cf.CompressThreshold < 0 {
+		e.add("CompressThreshold must not be negative, got %d", cf.CompressThreshold)
+	}
+
+	if _, err := NewIDGenerator(cf.IDGenerator, "", 0); err != nil {
+		e.add("IDGenerator %s is not a built-in generator", cf.IDGenerator)
+	}
+
+	if cf.SidHashKey != "" && len(cf.SidHashKey) < MinSidHashKeyLength {
+		e.add("SidHashKey must be at least %d bytes, got %d", MinSidHashKeyLength, len(cf.SidHashKey))
+	}
+
+	if cf.EnableSidInHTTPHeader {
+		if cf.SessionNameInHTTPHeader == "" {
+			e.add("SessionNameInHTTPHeader is empty")
+		} else if strMimeHeader := textproto.CanonicalMIMEHeaderKey(cf.SessionNameInHTTPHeader); cf.SessionNameInHTTPHeader != strMimeHeader {
+			e.add("SessionNameInHTTPHeader (%s) has the wrong format, it should be like this : %s", cf.SessionNameInHTTPHeader, strMimeHeader)
+		}
+	}
+
+	if strings.ContainsAny(cf.AuthorizationScheme, " \t") {
+		e.add("AuthorizationScheme %q must be a single token", cf.AuthorizationScheme)
+	}
+	seen := make(map[string]bool)
+	for _, source := range cf.SidSources {
+		switch source {
+		case SidSourceCookie, SidSourceQuery, SidSourceHeader, SidSourceAuthorization:
+		default:
+			e.add("SidSources has an unknown source %s", source)
+		}
+		if seen[source] {
+			e.add("SidSources has %s twice", source)
+		}
+		seen[source] = true
+	}
+
+	if _, ok := sameSiteMode(cf.CookieSameSite); !ok {
+		e.add("CookieSameSite must be lax, strict or none, got %s", cf.CookieSameSite)
+	}
+	if strings.EqualFold(cf.CookieSameSite, "none") && !cf.Secure {
+		e.add("CookieSameSite none requires Secure")
+	}
+	if cf.CookiePartitioned && !cf.Secure {
+		e.add("CookiePartitioned requires Secure")
+	}
+	if cf.CookiePath != "" && !strings.HasPrefix(cf.CookiePath, "/") {
+		e.add("CookiePath must start with /, got %s", cf.CookiePath)
+	}
+
+	for _, proxy := range cf.TrustedProxies {
+		if _, err := parseTrustedProxies([]string{proxy}); err != nil {
+			e.add("TrustedProxies has %s which is not an IP or CIDR", proxy)
+		}
+	}
+	switch cf.ProxyHeader {
+	case "", ProxyHeaderXForwarded, ProxyHeaderForwarded:
+	default:
+		e.add("ProxyHeader must be %s or %s, got %s", ProxyHeaderXForwarded, ProxyHeaderForwarded, cf.ProxyHeader)
+	}
+
+	// cookie name prefixes, see https://tools.ietf.org/html/draft-ietf-httpbis-rfc6265bis#section-4.1.3
+	if strings.HasPrefix(cf.CookieName, securePrefix) && !cf.Secure {
+		e.add("CookieName %s requires Secure", cf.CookieName)
+	}
+	if strings.HasPrefix(cf.CookieName, hostPrefix) {
+		if !cf.Secure {
+			e.add("CookieName %s requires Secure", cf.CookieName)
+		}
+		if cf.Domain != "" {
+			e.add("CookieName %s must not set Domain", cf.CookieName)
+		}
+		if cf.CookiePath != "" && cf.CookiePath != "/" {
+			e.add("CookieName %s requires CookiePath /", cf.CookieName)
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
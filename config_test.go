@@ -0,0 +1,46 @@
+package session_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/memory"
+)
+
+func TestManagerConfigValidate(t *testing.T) {
+	valid := func() session.ManagerConfig {
+		return session.ManagerConfig{CookieName: session.DefaultCookieName, Gclifetime: 3600}
+	}
+	if cf := valid(); cf.Validate() != nil {
+		t.Fatalf("Validate of a valid config: %v", cf.Validate())
+	}
+
+	tests := []struct {
+		field  string
+		config func(cf *session.ManagerConfig)
+	}{
+		{"Gclifetime", func(cf *session.ManagerConfig) { cf.Gclifetime = 0 }},
+		{"Gclifetime", func(cf *session.ManagerConfig) { cf.Gclifetime = -1 }},
+		{"SessionIDLength", func(cf *session.ManagerConfig) { cf.SessionIDLength = session.MinSessionIDLength - 1 }},
+		{"CookieName __Host-sid", func(cf *session.ManagerConfig) { cf.CookieName = "__Host-sid" }},
+		{"CookieName __Secure-sid", func(cf *session.ManagerConfig) { cf.CookieName = "__Secure-sid" }},
+		{"CookieSameSite", func(cf *session.ManagerConfig) { cf.CookieSameSite = "none" }},
+	}
+	for _, tt := range tests {
+		cf := valid()
+		tt.config(&cf)
+		var ce *session.ConfigError
+		if err := cf.Validate(); !errors.As(err, &ce) {
+			t.Errorf("%s: Validate = %v, want a *ConfigError", tt.field, err)
+			continue
+		}
+		if len(ce.Problems) != 1 || !strings.HasPrefix(ce.Problems[0], tt.field) {
+			t.Errorf("%s: problems %q, want one naming the field", tt.field, ce.Problems)
+		}
+		if _, err := session.New(memory.NewProvider(), session.WithConfig(cf)); !errors.As(err, &ce) {
+			t.Errorf("%s: New = %v, want a *ConfigError", tt.field, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package session
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cookie name prefixes, see https://tools.ietf.org/html/draft-ietf-httpbis-rfc6265bis#section-4.1.3
+const (
+	hostPrefix   = "__Host-"
+	securePrefix = "__Secure-"
+)
+
+// sameSiteMode returns the http.SameSite of a CookieSameSite name, 0 for an empty name
+func sameSiteMode(name string) (mode http.SameSite, ok bool) {
+	switch strings.ToLower(name) {
+	case "":
+		return 0, true
+	case "lax":
+		return http.SameSiteLaxMode, true
+	case "strict":
+		return http.SameSiteStrictMode, true
+	case "none":
+		return http.SameSiteNoneMode, true
+	}
+	return 0, false
+}
+
+// newCookie build the session cookie name with the attributes of the config, every session
+// cookie the Manager sends is made by it so that they can replace each other.
+// the attributes required by the cookie name prefix, SameSite=None and Partitioned
+// are enforced, the browsers would drop the cookie otherwise.
+func (manager *Manager) newCookie(r *http.Request, name, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     manager.config.CookiePath,
+		Domain:   manager.config.Domain,
+		HttpOnly: !manager.config.DisableHTTPOnly,
+		Secure:   manager.isSecure(r),
+	}
+	cookie.SameSite, _ = sameSiteMode(manager.config.CookieSameSite)
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+
+	if cookie.SameSite == http.SameSiteNoneMode || manager.config.CookiePartitioned {
+		cookie.Secure = true
+	}
+	switch {
+	case strings.HasPrefix(cookie.Name, hostPrefix):
+		cookie.Secure = true
+		cookie.Path = "/"
+		cookie.Domain = ""
+	case strings.HasPrefix(cookie.Name, securePrefix):
+		cookie.Secure = true
+	}
+	return cookie
+}
+
+// sessionCookie build the cookie carrying sid.
+func (manager *Manager) sessionCookie(r *http.Request, sid string) *http.Cookie {
+	cookie := manager.newCookie(r, manager.config.CookieName, url.QueryEscape(manager.signSid(sid)))
+	if manager.config.CookieLifeTime > 0 {
+		cookie.MaxAge = manager.config.CookieLifeTime
+		cookie.Expires = time.Now().Add(time.Duration(manager.config.CookieLifeTime) * time.Second)
+	}
+	return cookie
+}
+
+// expiredCookie build the cookie deleting the session cookie.
+func (manager *Manager) expiredCookie(r *http.Request) *http.Cookie {
+	cookie := manager.newCookie(r, manager.config.CookieName, "")
+	cookie.MaxAge = -1
+	cookie.Expires = time.Unix(1, 0)
+	return cookie
+}
+
+// cookieWriter returns the CookieWriter of the data cookies of a CookieRequestProvider for r,
+// they are HttpOnly as the scripts have no use of the sealed values.
+func (manager *Manager) cookieWriter(w http.ResponseWriter, r *http.Request) CookieWriter {
+	return func(name, value string, maxAge int) {
+		cookie := manager.newCookie(r, name, value)
+		cookie.HttpOnly = true
+		switch {
+		case maxAge < 0:
+			cookie.MaxAge = -1
+			cookie.Expires = time.Unix(1, 0)
+		case maxAge > 0:
+			cookie.MaxAge = maxAge
+			cookie.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+		}
+		manager.writeCookie(w, cookie)
+	}
+}
+
+// writeCookie add cookie to the response header.
+// http.Cookie has no Partitioned attribute, it is appended to the serialized cookie.
+func (manager *Manager) writeCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	if !manager.config.CookiePartitioned {
+		http.SetCookie(w, cookie)
+		return
+	}
+	if v := cookie.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; Partitioned")
+	}
+}
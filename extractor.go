@@ -0,0 +1,147 @@
+package session
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sources of the session id, for ManagerConfig.SidSources and Extractor.Source
+const (
+	SidSourceCookie        = "cookie"
+	SidSourceQuery         = "query"
+	SidSourceHeader        = "header"
+	SidSourceAuthorization = "authorization"
+)
+
+// DefaultSidSources is the order the session id is looked for when SidSources is empty
+var DefaultSidSources = []string{SidSourceCookie, SidSourceQuery, SidSourceHeader, SidSourceAuthorization}
+
+// DefaultAuthorizationScheme is the scheme of the Authorization header carrying the session id
+const DefaultAuthorizationScheme = "Bearer"
+
+// Extractor finds the session id in a request.
+type Extractor interface {
+	Source() string                          // reported as the source of the session id it finds
+	Extract(r *http.Request) (string, error) // the session id, empty if r carries none
+}
+
+// CookieExtractor reads the session id from the cookie Name.
+type CookieExtractor struct {
+	Name string
+}
+
+// Source returns SidSourceCookie
+func (e CookieExtractor) Source() string {
+	return SidSourceCookie
+}
+
+// Extract implement Extractor
+func (e CookieExtractor) Extract(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(e.Name)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+	return url.QueryUnescape(cookie.Value)
+}
+
+// HeaderExtractor reads the session id from the http header Header.
+type HeaderExtractor struct {
+	Header string
+}
+
+// Source returns SidSourceHeader
+func (e HeaderExtractor) Source() string {
+	return SidSourceHeader
+}
+
+// Extract implement Extractor
+func (e HeaderExtractor) Extract(r *http.Request) (string, error) {
+	return r.Header.Get(e.Header), nil
+}
+
+// BearerExtractor reads the session id from the Authorization header as "<Scheme> <sid>",
+// the scheme is compared case-insensitively and defaults to DefaultAuthorizationScheme.
+type BearerExtractor struct {
+	Scheme string
+}
+
+// Source returns SidSourceAuthorization
+func (e BearerExtractor) Source() string {
+	return SidSourceAuthorization
+}
+
+// Extract implement Extractor
+func (e BearerExtractor) Extract(r *http.Request) (string, error) {
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = DefaultAuthorizationScheme
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) || auth[len(scheme)] != ' ' {
+		return "", nil
+	}
+	return strings.TrimSpace(auth[len(scheme)+1:]), nil
+}
+
+// QueryExtractor reads the session id from the url query parameter Param.
+// it does not call r.ParseForm, so the request body is left unread.
+type QueryExtractor struct {
+	Param string
+}
+
+// Source returns SidSourceQuery
+func (e QueryExtractor) Source() string {
+	return SidSourceQuery
+}
+
+// Extract implement Extractor
+func (e QueryExtractor) Extract(r *http.Request) (string, error) {
+	return r.URL.Query().Get(e.Param), nil
+}
+
+type funcExtractor struct {
+	source  string
+	extract func(r *http.Request) (string, error)
+}
+
+func (e funcExtractor) Source() string {
+	return e.source
+}
+
+func (e funcExtractor) Extract(r *http.Request) (string, error) {
+	return e.extract(r)
+}
+
+// ExtractorFunc makes an Extractor of f, reporting source as the source of the session ids it finds.
+func ExtractorFunc(source string, f func(r *http.Request) (string, error)) Extractor {
+	return funcExtractor{source: source, extract: f}
+}
+
+// sidExtractors returns the extractors set by WithExtractors, or those of the
+// enabled sources of the config in the SidSources order.
+func (manager *Manager) sidExtractors() []Extractor {
+	if manager.extractors != nil {
+		return manager.extractors
+	}
+
+	cf := manager.config
+	sources := cf.SidSources
+	if len(sources) == 0 {
+		sources = DefaultSidSources
+	}
+	extractors := make([]Extractor, 0, len(sources))
+	for _, source := range sources {
+		switch {
+		case source == SidSourceCookie:
+			extractors = append(extractors, CookieExtractor{Name: cf.CookieName})
+		case source == SidSourceQuery && cf.EnableSidInURLQuery:
+			extractors = append(extractors, QueryExtractor{Param: cf.CookieName})
+		case source == SidSourceHeader && cf.EnableSidInHTTPHeader:
+			extractors = append(extractors, HeaderExtractor{Header: cf.SessionNameInHTTPHeader})
+		case source == SidSourceAuthorization && cf.EnableSidInAuthorization:
+			extractors = append(extractors, BearerExtractor{Scheme: cf.AuthorizationScheme})
+		}
+	}
+	return extractors
+}
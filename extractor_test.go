@@ -0,0 +1,185 @@
+package session_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/memory"
+)
+
+func TestSidSources(t *testing.T) {
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithSessionIDHeader("X-Session-Id"),
+		session.WithSessionIDInURLQuery(true),
+		session.WithSidSources(session.SidSourceHeader, session.SidSourceQuery, session.SidSourceCookie))
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithExtractors(
+			session.ExtractorFunc("custom", func(r *http.Request) (string, error) {
+				return r.Header.Get("X-Custom"), nil
+			}),
+			session.CookieExtractor{Name: session.DefaultCookieName}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		cookieSid = "0123456789abcdef0123456789abcdef"
+		headerSid = "1123456789abcdef0123456789abcdef"
+		querySid  = "2123456789abcdef0123456789abcdef"
+	)
+	tests := []struct {
+		name    string
+		manager *session.Manager
+		cookie  string
+		header  string
+		query   string
+		custom  string
+		sid     string
+		source  string
+	}{
+		{"cookie", manager, cookieSid, "", "", "", cookieSid, session.SidSourceCookie},
+		{"query", manager, cookieSid, "", querySid, "", querySid, session.SidSourceQuery},
+		{"header first", manager, cookieSid, headerSid, querySid, "", headerSid, session.SidSourceHeader},
+		{"invalid header", manager, cookieSid, "not-a-session-id", querySid, "", "", ""},
+		{"none", manager, "", "", "", "", "", ""},
+		{"custom", custom, cookieSid, "", "", headerSid, headerSid, "custom"},
+		{"custom missing", custom, cookieSid, "", "", "", cookieSid, session.SidSourceCookie},
+		{"invalid custom", custom, cookieSid, "", "", "x", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?"+session.DefaultCookieName+"="+tt.query, nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: session.DefaultCookieName, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			r.Header.Set("X-Session-Id", tt.header)
+		}
+		if tt.custom != "" {
+			r.Header.Set("X-Custom", tt.custom)
+		}
+		sid, source, err := tt.manager.ExtractSid(r)
+		if err != nil || sid != tt.sid || source != tt.source {
+			t.Errorf("%s: ExtractSid = %q, %q, %v, want %q, %q", tt.name, sid, source, err, tt.sid, tt.source)
+		}
+	}
+}
+
+func TestSidSourceFromContext(t *testing.T) {
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithSessionIDHeader("X-Session-Id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		header, source string
+	}{
+		{st.SessionID(), session.SidSourceHeader},
+		{"", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Session-Id", tt.header)
+		}
+		var source string
+		manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			source = session.SidSourceFromContext(r.Context())
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if source != tt.source {
+			t.Errorf("header %q: SidSourceFromContext = %q, want %q", tt.header, source, tt.source)
+		}
+	}
+}
+
+func TestDestroyAndRegenerateFromHeader(t *testing.T) {
+	provider := memory.NewProvider()
+	manager, err := session.New(provider,
+		session.WithGCLifetime(time.Hour),
+		session.WithExtractors(session.HeaderExtractor{Header: "X-Session-Id"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(sid string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Session-Id", sid)
+		return r
+	}
+
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set("user", "alice")
+	oldSid := st.SessionID()
+	regenerated := manager.SessionRegenerateID(httptest.NewRecorder(), request(oldSid))
+	if regenerated == nil || regenerated.Get("user") != "alice" {
+		t.Fatalf("SessionRegenerateID did not regenerate the session of the header: %v", regenerated)
+	}
+	if provider.SessionExist(oldSid) {
+		t.Error("the old session still exists")
+	}
+
+	manager.SessionDestroy(httptest.NewRecorder(), request(regenerated.SessionID()))
+	if provider.SessionExist(regenerated.SessionID()) {
+		t.Error("SessionDestroy left the session of the header alive")
+	}
+}
+
+func TestRejectedIDs(t *testing.T) {
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithSessionIDHeader("X-Session-Id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const bad = "not-a-session-id"
+	tests := []struct {
+		name    string
+		request func(r *http.Request)
+	}{
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: session.DefaultCookieName, Value: bad}) }},
+		{"header", func(r *http.Request) { r.Header.Set("X-Session-Id", bad) }},
+	}
+	for _, tt := range tests {
+		before := manager.RejectedIDs()
+		r := httptest.NewRequest("GET", "/", nil)
+		tt.request(r)
+		var sid string
+		w := httptest.NewRecorder()
+		manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sid = session.FromContext(r.Context()).SessionID()
+		})).ServeHTTP(w, r)
+		if sid == "" || sid == bad || len(sid) != 2*session.DefaultSessionIDLength {
+			t.Errorf("%s: session %q, want a fresh one", tt.name, sid)
+		}
+		if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != sid {
+			t.Errorf("%s: cookies %v, want the fresh session", tt.name, cookies)
+		}
+		if n := manager.RejectedIDs() - before; n != 1 {
+			t.Errorf("%s: RejectedIDs grew by %d, want 1", tt.name, n)
+		}
+	}
+
+	// a well formed id of no session is not a rejection
+	before := manager.RejectedIDs()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: session.DefaultCookieName, Value: "0123456789abcdef0123456789abcdef"})
+	if _, err := manager.SessionStart(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if n := manager.RejectedIDs() - before; n != 0 {
+		t.Errorf("an unknown id grew RejectedIDs by %d", n)
+	}
+}
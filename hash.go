@@ -0,0 +1,132 @@
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/misu99/session/store"
+)
+
+// MinSidHashKeyLength is the minimal length of the key hashing the session ids, in bytes
+const MinSidHashKeyLength = 32
+
+// hashedProvider stores every session under the HMAC-SHA256 of its id, so that
+// the backend never holds a working session id. the stores it returns still
+// report the plaintext id, SessionAll returns the hashes.
+type hashedProvider struct {
+	ContextProvider
+	key []byte
+}
+
+func hashSids(provider ContextProvider, key []byte) ContextProvider {
+	return &hashedProvider{ContextProvider: provider, key: append([]byte(nil), key...)}
+}
+
+func (hp *hashedProvider) hash(sid string) string {
+	h := hmac.New(sha256.New, hp.key)
+	h.Write([]byte(sid))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (hp *hashedProvider) wrap(st store.Store, sid string, err error) (store.Store, error) {
+	if st == nil || err != nil {
+		return st, err
+	}
+	return &hashedStore{Store: st, sid: sid}, nil
+}
+
+func (hp *hashedProvider) SessionNew(sid string, lifetime int64) (store.Store, error) {
+	return hp.SessionNewContext(context.Background(), sid, lifetime)
+}
+
+func (hp *hashedProvider) SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error) {
+	st, err := hp.ContextProvider.SessionNewContext(ctx, hp.hash(sid), lifetime)
+	return hp.wrap(st, sid, err)
+}
+
+func (hp *hashedProvider) SessionRead(sid string) (store.Store, error) {
+	return hp.SessionReadContext(context.Background(), sid)
+}
+
+func (hp *hashedProvider) SessionReadContext(ctx context.Context, sid string) (store.Store, error) {
+	st, err := hp.ContextProvider.SessionReadContext(ctx, hp.hash(sid))
+	return hp.wrap(st, sid, err)
+}
+
+func (hp *hashedProvider) SessionExist(sid string) bool {
+	return hp.SessionExistContext(context.Background(), sid)
+}
+
+func (hp *hashedProvider) SessionExistContext(ctx context.Context, sid string) bool {
+	return hp.ContextProvider.SessionExistContext(ctx, hp.hash(sid))
+}
+
+func (hp *hashedProvider) SessionRegenerate(oldsid, sid string) (store.Store, error) {
+	return hp.SessionRegenerateContext(context.Background(), oldsid, sid)
+}
+
+func (hp *hashedProvider) SessionRegenerateContext(ctx context.Context, oldsid, sid string) (store.Store, error) {
+	st, err := hp.ContextProvider.SessionRegenerateContext(ctx, hp.hash(oldsid), hp.hash(sid))
+	return hp.wrap(st, sid, err)
+}
+
+func (hp *hashedProvider) SessionDestroy(sid string) error {
+	return hp.SessionDestroyContext(context.Background(), sid)
+}
+
+func (hp *hashedProvider) SessionDestroyContext(ctx context.Context, sid string) error {
+	return hp.ContextProvider.SessionDestroyContext(ctx, hp.hash(sid))
+}
+
+// hashedStore is a store of hashedProvider, it reports the plaintext session id
+type hashedStore struct {
+	store.Store
+	sid string
+}
+
+func (st *hashedStore) SessionID() string {
+	return st.sid
+}
+
+func (st *hashedStore) SessionDelayContext(ctx context.Context) {
+	store.DelayContext(ctx, st.Store)
+}
+
+func (st *hashedStore) SessionReleaseContext(ctx context.Context) error {
+	return store.ReleaseContext(ctx, st.Store)
+}
+
+func (st *hashedStore) Dirty() bool {
+	d, ok := st.Store.(interface{ Dirty() bool })
+	return ok && d.Dirty()
+}
+
+func (st *hashedStore) MarkDirty() {
+	store.MarkDirty(st.Store)
+}
+
+func (st *hashedStore) Lifetime() int64 {
+	l, ok := st.Store.(interface{ Lifetime() int64 })
+	if !ok {
+		return 0
+	}
+	return l.Lifetime()
+}
+
+// backend returns the provider storing the sessions by their backend keys
+func backend(provider ContextProvider) ContextProvider {
+	if hp, ok := provider.(*hashedProvider); ok {
+		return hp.ContextProvider
+	}
+	return provider
+}
+
+// BackendKey returns the key the session sid is stored under in the provider,
+// it is the hash of sid if the ids are hashed, sid itself otherwise.
+func (manager *Manager) BackendKey(sid string) string {
+	if hp, ok := manager.provider.(*hashedProvider); ok {
+		return hp.hash(sid)
+	}
+	return sid
+}
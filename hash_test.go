@@ -0,0 +1,86 @@
+package session_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+)
+
+func TestSidHashKey(t *testing.T) {
+	key := []byte(strings.Repeat("k", session.MinSidHashKeyLength))
+	hash := func(sid string) string {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(sid))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, provider := range testProviders(dir) {
+		manager, err := session.New(provider, session.WithGCLifetime(time.Hour), session.WithSidHashKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := func(want string) {
+			t.Helper()
+			all, err := provider.SessionAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want == "" && len(all) != 0 || want != "" && (len(all) != 1 || all[0] != want) {
+				t.Errorf("%s: stored %v, want %q", name, all, want)
+			}
+		}
+		request := func(sid string) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: session.DefaultCookieName, Value: sid})
+			return r
+		}
+
+		st, err := manager.TokenStart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Set("user", "alice")
+		if err := st.SessionRelease(); err != nil {
+			t.Fatal(err)
+		}
+		sid := st.SessionID()
+		if manager.BackendKey(sid) != hash(sid) {
+			t.Errorf("%s: BackendKey = %q, want the HMAC of the id", name, manager.BackendKey(sid))
+		}
+		stored(hash(sid))
+		if name == "file" {
+			h := hash(sid)
+			if _, err := os.Stat(filepath.Join(dir, h[:1], h[1:2], h)); err != nil {
+				t.Errorf("file: the session file is not named by the HMAC: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, sid[:1], sid[1:2], sid)); !os.IsNotExist(err) {
+				t.Errorf("file: a session file is named by the plain id")
+			}
+		}
+		if st, err = manager.GetSessionStore(sid); err != nil || st.SessionID() != sid || st.Get("user") != "alice" {
+			t.Fatalf("%s: GetSessionStore(%q) = %v, %v", name, sid, st, err)
+		}
+
+		regenerated := manager.SessionRegenerateID(httptest.NewRecorder(), request(sid))
+		if regenerated == nil || regenerated.SessionID() == sid || regenerated.Get("user") != "alice" {
+			t.Fatalf("%s: SessionRegenerateID = %v", name, regenerated)
+		}
+		if err := regenerated.SessionRelease(); err != nil {
+			t.Fatal(err)
+		}
+		stored(hash(regenerated.SessionID()))
+
+		manager.SessionDestroy(httptest.NewRecorder(), request(regenerated.SessionID()))
+		stored("")
+	}
+}
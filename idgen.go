@@ -0,0 +1,261 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSessionID is returned for session ids which do not match the format of the id generator
+var ErrInvalidSessionID = errors.New("session: invalid session id")
+
+// MaxSessionIDLength is the max length of a session id made by a generator without a Validate method
+const MaxSessionIDLength = 256
+
+// IDGenerator generates new session ids.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// IDGeneratorFunc is an adapter to allow the use of ordinary functions as IDGenerator.
+type IDGeneratorFunc func() (string, error)
+
+// NewID calls f()
+func (f IDGeneratorFunc) NewID() (string, error) {
+	return f()
+}
+
+// names of the built-in generators, for ManagerConfig.IDGenerator
+const (
+	IDGeneratorHex       = "hex"
+	IDGeneratorBase64URL = "base64url"
+	IDGeneratorUUID      = "uuid"
+	IDGeneratorULID      = "ulid"
+	IDGeneratorToken     = "token"
+)
+
+// NewIDGenerator returns the built-in generator by its name, prefix and length
+// are only used by hex, base64url and token, length is the number of random bytes.
+func NewIDGenerator(name, prefix string, length int) (IDGenerator, error) {
+	switch name {
+	case "", IDGeneratorHex:
+		return HexIDGenerator{Prefix: prefix, Length: length}, nil
+	case IDGeneratorBase64URL:
+		return Base64URLIDGenerator{Prefix: prefix, Length: length}, nil
+	case IDGeneratorUUID:
+		return UUIDGenerator{}, nil
+	case IDGeneratorULID:
+		return ULIDGenerator{}, nil
+	case IDGeneratorToken:
+		return TokenIDGenerator{Prefix: prefix, Length: length}, nil
+	}
+	return nil, fmt.Errorf("session: unknown id generator %q", name)
+}
+
+// HexIDGenerator generates Prefix followed by the hex of Length random bytes,
+// it is the default generator.
+type HexIDGenerator struct {
+	Prefix string
+	Length int // zero means DefaultSessionIDLength, it must be at least MinSessionIDLength
+}
+
+// NewID implement IDGenerator
+func (g HexIDGenerator) NewID() (string, error) {
+	n, err := idLength(g.Length)
+	if err != nil {
+		return "", err
+	}
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return g.Prefix + hex.EncodeToString(b), nil
+}
+
+// Validate check sid has the prefix and the length of g and is lowercase hex,
+// so that ids made before changing Prefix or Length are rejected.
+func (g HexIDGenerator) Validate(sid string) error {
+	n, err := idLength(g.Length)
+	if err != nil {
+		return err
+	}
+	return validateID(sid, g.Prefix, hex.EncodedLen(n), "0123456789abcdef")
+}
+
+func (g HexIDGenerator) checkLength() error {
+	_, err := idLength(g.Length)
+	return err
+}
+
+// Base64URLIDGenerator generates Prefix followed by the unpadded base64url of Length random bytes,
+// it is shorter than hex for the same entropy.
+type Base64URLIDGenerator struct {
+	Prefix string
+	Length int // zero means DefaultSessionIDLength, it must be at least MinSessionIDLength
+}
+
+// NewID implement IDGenerator
+func (g Base64URLIDGenerator) NewID() (string, error) {
+	n, err := idLength(g.Length)
+	if err != nil {
+		return "", err
+	}
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return g.Prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Validate check sid has the prefix and the length of g and is unpadded base64url
+func (g Base64URLIDGenerator) Validate(sid string) error {
+	n, err := idLength(g.Length)
+	if err != nil {
+		return err
+	}
+	return validateID(sid, g.Prefix, base64.RawURLEncoding.EncodedLen(n),
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_")
+}
+
+func (g Base64URLIDGenerator) checkLength() error {
+	_, err := idLength(g.Length)
+	return err
+}
+
+// UUIDGenerator generates random UUIDs (version 4), such as 0b8e1c2a-5f3d-4e7b-9a1c-2d3e4f5a6b7c.
+type UUIDGenerator struct{}
+
+// NewID implement IDGenerator
+func (UUIDGenerator) NewID() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Validate check sid is a lowercase UUID of version 4
+func (UUIDGenerator) Validate(sid string) error {
+	if len(sid) != 36 || sid[14] != '4' {
+		return ErrInvalidSessionID
+	}
+	for i := 0; i < len(sid); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if sid[i] != '-' {
+				return ErrInvalidSessionID
+			}
+		default:
+			if strings.IndexByte("0123456789abcdef", sid[i]) < 0 {
+				return ErrInvalidSessionID
+			}
+		}
+	}
+	return nil
+}
+
+// ULIDGenerator generates ULIDs, 48 bits of milliseconds followed by 80 random bits
+// in Crockford's base32, so that the ids sort by creation time.
+type ULIDGenerator struct{}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewID implement IDGenerator
+func (ULIDGenerator) NewID() (string, error) {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", errors.New("could not successfully read from the system CSPRNG")
+	}
+
+	// 128 bits in 26 characters of 5 bits, the first one only holds 3 bits
+	id := make([]byte, 26)
+	var acc uint
+	var bits uint
+	j := 25
+	for i := 15; i >= 0; i-- {
+		acc |= uint(b[i]) << bits
+		bits += 8
+		for bits >= 5 && j >= 0 {
+			id[j] = crockford[acc&31]
+			acc >>= 5
+			bits -= 5
+			j--
+		}
+	}
+	id[0] = crockford[acc&31]
+	return string(id), nil
+}
+
+// Validate check sid is an uppercase ULID
+func (ULIDGenerator) Validate(sid string) error {
+	if len(sid) != 26 || sid[0] > '7' {
+		return ErrInvalidSessionID
+	}
+	return validateID(sid, "", 26, crockford)
+}
+
+// validateID check id is prefix followed by length characters of charset
+func validateID(id, prefix string, length int, charset string) error {
+	if len(id) != len(prefix)+length || !strings.HasPrefix(id, prefix) {
+		return ErrInvalidSessionID
+	}
+	for i := len(prefix); i < len(id); i++ {
+		if strings.IndexByte(charset, id[i]) < 0 {
+			return ErrInvalidSessionID
+		}
+	}
+	return nil
+}
+
+// validateAny is the check of the ids made by a generator without a Validate method:
+// at most MaxSessionIDLength printable ascii characters without space.
+func validateAny(id string) error {
+	if id == "" || len(id) > MaxSessionIDLength {
+		return ErrInvalidSessionID
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return ErrInvalidSessionID
+		}
+	}
+	return nil
+}
+
+// idLength returns the number of random bytes of a generator Length,
+// zero is DefaultSessionIDLength, a length below MinSessionIDLength is an error.
+func idLength(length int) (int, error) {
+	if length == 0 {
+		return DefaultSessionIDLength, nil
+	}
+	if length < MinSessionIDLength {
+		return 0, fmt.Errorf("session: id generator length must be at least %d bytes, got %d", MinSessionIDLength, length)
+	}
+	return length, nil
+}
+
+// checkGenerator reject a built-in generator whose Length is too short to be safe
+func checkGenerator(g IDGenerator) error {
+	if c, ok := g.(interface{ checkLength() error }); ok {
+		return c.checkLength()
+	}
+	return nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.New("could not successfully read from the system CSPRNG")
+	}
+	return b, nil
+}
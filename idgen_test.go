@@ -0,0 +1,118 @@
+package session
+
+import (
+	"errors"
+	"github.com/misu99/session/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGeneratorsValidateTheirIDs(t *testing.T) {
+	generators := map[string]IDGenerator{
+		"hex":            HexIDGenerator{},
+		"hex prefix":     HexIDGenerator{Prefix: "s-", Length: 24},
+		"base64url":      Base64URLIDGenerator{},
+		"base64url long": Base64URLIDGenerator{Length: 32},
+		"uuid":           UUIDGenerator{},
+		"ulid":           ULIDGenerator{},
+	}
+	for name, g := range generators {
+		v := g.(interface{ Validate(string) error })
+		seen := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			id, err := g.NewID()
+			if err != nil {
+				t.Fatalf("%s: NewID: %v", name, err)
+			}
+			if err := v.Validate(id); err != nil {
+				t.Errorf("%s: Validate(%q): %v", name, id, err)
+			}
+			if seen[id] {
+				t.Fatalf("%s: NewID returned %q twice", name, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestGeneratorsDefaultLength(t *testing.T) {
+	id, err := HexIDGenerator{}.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 2*DefaultSessionIDLength {
+		t.Errorf("HexIDGenerator{} made %q, want %d hex characters", id, 2*DefaultSessionIDLength)
+	}
+}
+
+func TestGeneratorsRejectShortLength(t *testing.T) {
+	for _, g := range []IDGenerator{
+		HexIDGenerator{Length: 4},
+		Base64URLIDGenerator{Length: MinSessionIDLength - 1},
+		HexIDGenerator{Length: -1},
+	} {
+		if id, err := g.NewID(); err == nil {
+			t.Errorf("%#v made %q, want an error", g, id)
+		}
+		if _, err := New(nopProvider{}, WithIDGenerator(g)); err == nil {
+			t.Errorf("New accepted %#v", g)
+		}
+	}
+}
+
+func TestGeneratorsRejectForeignIDs(t *testing.T) {
+	tests := []struct {
+		g  interface{ Validate(string) error }
+		id string
+	}{
+		{HexIDGenerator{}, strings.Repeat("a", 31)},
+		{HexIDGenerator{}, strings.Repeat("A", 32)},
+		{HexIDGenerator{Prefix: "p-"}, strings.Repeat("a", 32)},
+		{Base64URLIDGenerator{}, strings.Repeat("+", 22)},
+		{UUIDGenerator{}, "0b8e1c2a-5f3d-3e7b-9a1c-2d3e4f5a6b7c"},
+		{UUIDGenerator{}, "0b8e1c2a5f3d4e7b9a1c2d3e4f5a6b7c"},
+		{ULIDGenerator{}, "01ARZ3NDEKTSV4RRFFQ69G5FAU"},
+		{ULIDGenerator{}, "81ARZ3NDEKTSV4RRFFQ69G5FAV"},
+	}
+	for _, tt := range tests {
+		if err := tt.g.Validate(tt.id); err == nil {
+			t.Errorf("%#v accepted %q", tt.g, tt.id)
+		}
+	}
+}
+
+// nopProvider is a Provider without any session, for the tests of the Manager setup
+type nopProvider struct{}
+
+func (nopProvider) SessionInit(int64, string) error               { return nil }
+func (nopProvider) SessionNew(string, int64) (store.Store, error) { return nil, errors.New("nop") }
+func (nopProvider) SessionRead(string) (store.Store, error)       { return nil, errors.New("nop") }
+func (nopProvider) SessionExist(string) bool                      { return false }
+func (nopProvider) SessionRegenerate(string, string) (store.Store, error) {
+	return nil, errors.New("nop")
+}
+func (nopProvider) SessionDestroy(string) error   { return nil }
+func (nopProvider) SessionAll() ([]string, error) { return nil, nil }
+func (nopProvider) SessionGC()                    {}
+
+func TestULIDEncodesTime(t *testing.T) {
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	id, err := ULIDGenerator{}.NewID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if after := time.Now().UnixNano() / int64(time.Millisecond); ms < before || ms > after {
+		t.Errorf("ULID %s encodes %d ms, want between %d and %d", id, ms, before, after)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	next, _ := ULIDGenerator{}.NewID()
+	if next <= id {
+		t.Errorf("ULID %s made later does not sort after %s", next, id)
+	}
+}
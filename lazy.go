@@ -0,0 +1,171 @@
+package session
+
+import (
+	"context"
+	"github.com/misu99/session/store"
+	"sync"
+)
+
+// lazyStore is a new session kept in memory until a value is set,
+// the provider is only touched by the release of a store that has been written.
+type lazyStore struct {
+	provider ContextProvider
+	sid      string
+	lock     sync.RWMutex
+	values   map[interface{}]interface{}
+	written  bool
+	onWrite  func()      // called once, on the first Set
+	released store.Store // the provider store once the session is saved
+}
+
+func newLazyStore(provider ContextProvider, sid string) *lazyStore {
+	return &lazyStore{provider: provider, sid: sid, values: make(map[interface{}]interface{})}
+}
+
+// Set value in lazy session, the first Set makes the session persistent
+func (st *lazyStore) Set(key, value interface{}) error {
+	st.lock.Lock()
+	if st.released != nil {
+		st.lock.Unlock()
+		return st.released.Set(key, value)
+	}
+	st.values[key] = value
+	onWrite := st.markWritten()
+	st.lock.Unlock()
+
+	if onWrite != nil {
+		onWrite()
+	}
+	return nil
+}
+
+// markWritten make the session persistent, it returns onWrite the first time only.
+// st.lock must be held.
+func (st *lazyStore) markWritten() func() {
+	first := !st.written
+	st.written = true
+	if !first {
+		return nil
+	}
+	return st.onWrite
+}
+
+// MarkDirty make the lazy session persistent as a Set does
+func (st *lazyStore) MarkDirty() {
+	st.lock.Lock()
+	if st.released != nil {
+		st.lock.Unlock()
+		store.MarkDirty(st.released)
+		return
+	}
+	onWrite := st.markWritten()
+	st.lock.Unlock()
+
+	if onWrite != nil {
+		onWrite()
+	}
+}
+
+// setMeta set a value without making the session persistent
+func (st *lazyStore) setMeta(key, value interface{}) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.released != nil {
+		st.released.Set(key, value)
+		return
+	}
+	st.values[key] = value
+}
+
+// Get value from lazy session
+func (st *lazyStore) Get(key interface{}) interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	if st.released != nil {
+		return st.released.Get(key)
+	}
+	if v, ok := st.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete value in lazy session
+func (st *lazyStore) Delete(key interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.released != nil {
+		return st.released.Delete(key)
+	}
+	if !store.IsMetadata(key) {
+		delete(st.values, key)
+	}
+	return nil
+}
+
+// Flush clear all values in lazy session
+func (st *lazyStore) Flush() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.released != nil {
+		return st.released.Flush()
+	}
+	st.values = store.KeepMetadata(st.values)
+	return nil
+}
+
+// SessionID get the id of lazy session
+func (st *lazyStore) SessionID() string {
+	return st.sid
+}
+
+// SessionDelay is a no-op until the session is saved
+func (st *lazyStore) SessionDelay() {
+	st.SessionDelayContext(context.Background())
+}
+
+// SessionDelayContext is a no-op until the session is saved
+func (st *lazyStore) SessionDelayContext(ctx context.Context) {
+	st.lock.RLock()
+	released := st.released
+	st.lock.RUnlock()
+	if released != nil {
+		store.DelayContext(ctx, released)
+	}
+}
+
+// SessionRelease save the session to the provider if a value has been set
+func (st *lazyStore) SessionRelease() error {
+	return st.SessionReleaseContext(context.Background())
+}
+
+// SessionReleaseContext save the session to the provider if a value has been set,
+// the provider calls are bounded by ctx
+func (st *lazyStore) SessionReleaseContext(ctx context.Context) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.released == nil {
+		if !st.written {
+			return nil
+		}
+		released, err := st.provider.SessionNewContext(ctx, st.sid, 0)
+		if err != nil {
+			return err
+		}
+		for k, v := range st.values {
+			if err := released.Set(k, v); err != nil {
+				return err
+			}
+		}
+		st.released = released
+		st.values = nil
+	}
+	return store.ReleaseContext(ctx, st.released)
+}
+
+// isWritten reports whether a value has been set
+func (st *lazyStore) isWritten() bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.written
+}
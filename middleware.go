@@ -0,0 +1,215 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/misu99/session/store"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type contextKey struct{}
+
+type sourceKey struct{}
+
+// requestState holds the session of Manager.Middleware in the request context,
+// SessionRegenerateID replaces it and SessionDestroy marks it destroyed, so that
+// the Middleware saves the current session only.
+type requestState struct {
+	lock        sync.Mutex
+	session     store.Store
+	regenerated bool
+	destroyed   bool
+}
+
+func (s *requestState) get() (st store.Store, regenerated, destroyed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.session, s.regenerated, s.destroyed
+}
+
+// stateFromContext returns the requestState of Manager.Middleware in ctx, nil if there is none
+func stateFromContext(ctx context.Context) *requestState {
+	s, _ := ctx.Value(contextKey{}).(*requestState)
+	return s
+}
+
+// NewContext returns a copy of ctx carrying the session st.
+func NewContext(ctx context.Context, st store.Store) context.Context {
+	return context.WithValue(ctx, contextKey{}, st)
+}
+
+// FromContext returns the session put in ctx by Manager.Middleware or NewContext,
+// it is nil if there is none. under the Middleware it is the regenerated session
+// once SessionRegenerateID has been called.
+func FromContext(ctx context.Context) store.Store {
+	switch v := ctx.Value(contextKey{}).(type) {
+	case *requestState:
+		st, _, _ := v.get()
+		return st
+	case store.Store:
+		return v
+	}
+	return nil
+}
+
+// SidSourceFromContext returns where Manager.Middleware found the id of the session
+// in ctx, such as SidSourceCookie, it is empty for a new session.
+func SidSourceFromContext(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
+
+// Middleware loads the session of the request or creates a new one, and puts it
+// in the request context, handlers get it by FromContext(r.Context()).
+// the session id of a new session is sent right before the response header is written,
+// with LazySession only if a value has been set by then.
+// the session is released once when next returns, unless SessionDestroy has destroyed it,
+// if SessionRegenerateID has replaced it, the regenerated session is released instead.
+// if it fails before next has written the response, the error is handled by the
+// ReleaseErrorHandler, otherwise it can only be logged.
+// with a RequestProvider the session is saved in the response header, so it is
+// released right before the header is written, changes made after are lost.
+func (manager *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		session, source, isNew, err := manager.sessionLoad(rw, r)
+		if err != nil {
+			manager.logger.Println(err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		state := &requestState{session: session}
+		ctx := context.WithValue(r.Context(), contextKey{}, state)
+		ctx = context.WithValue(ctx, sourceKey{}, source)
+		inHeader := manager.inHeader()
+		released, releaseFailed := false, false
+		release := func() error {
+			current, _, destroyed := state.get()
+			if destroyed {
+				// SessionDestroy removed it, saving it would bring it back
+				return nil
+			}
+			return store.ReleaseContext(ctx, current)
+		}
+		ls, lazy := session.(*lazyStore)
+		sent := false
+		sid := session.SessionID()
+		cookie := manager.sessionCookie(r, sid)
+		if isNew {
+			if lazy {
+				ls.onWrite = func() {
+					if _, regenerated, _ := state.get(); !regenerated {
+						manager.setRequestSid(r, cookie, sid)
+					}
+				}
+			} else {
+				manager.setRequestSid(r, cookie, sid)
+			}
+		}
+		rw.beforeWrite = func() {
+			if inHeader && !released {
+				released = true
+				if err := release(); err != nil {
+					manager.logger.Println(err)
+					releaseFailed = true
+				}
+			}
+			// SessionRegenerateID sends the id of the session replacing a new one
+			_, regenerated, destroyed := state.get()
+			if isNew && !regenerated && !destroyed && (!lazy || ls.isWritten()) {
+				manager.setResponseSid(w, cookie, sid)
+				sent = true
+			}
+		}
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+		current, regenerated, destroyed := state.get()
+		if isNew && lazy && !regenerated && rw.done && !sent && ls.isWritten() {
+			manager.logger.Println("session: " + sid + " is set after the response header is written, the client does not get the session id")
+		}
+		if rw.done {
+			if released {
+				if d, ok := current.(interface{ Dirty() bool }); !releaseFailed && !destroyed && ok && d.Dirty() {
+					manager.logger.Println("session: " + current.SessionID() + " is changed after the response header is written, the change is lost")
+				}
+				return
+			}
+			if err := release(); err != nil {
+				manager.logger.Println(err)
+			}
+			return
+		}
+		released = true
+		if err := release(); err != nil {
+			manager.logger.Println(err)
+			rw.done = true // do not send the id of a session that is not saved
+			manager.releaseErrorHandler(w, r, err)
+			return
+		}
+		rw.before()
+	})
+}
+
+// ReleaseErrorHandler handles the error of saving the session in Manager.Middleware.
+type ReleaseErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// defaultReleaseErrorHandler reply 503 so that the client can retry
+func defaultReleaseErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// responseWriter calls beforeWrite once before the header is written,
+// so that the session cookie still can be set.
+type responseWriter struct {
+	http.ResponseWriter
+	beforeWrite func()
+	done        bool
+}
+
+func (rw *responseWriter) before() {
+	if rw.done {
+		return
+	}
+	rw.done = true
+	if rw.beforeWrite != nil {
+		rw.beforeWrite()
+	}
+}
+
+// WriteHeader implement http.ResponseWriter
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.before()
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Write implement http.ResponseWriter
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.before()
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush implement http.Flusher
+func (rw *responseWriter) Flush() {
+	rw.before()
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implement http.Hijacker
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw.before()
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("session: the ResponseWriter does not implement http.Hijacker")
+}
+
+// Unwrap returns the original ResponseWriter, it is used by http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,257 @@
+package session_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/file"
+	"github.com/misu99/session/provider/memory"
+	"github.com/misu99/session/store"
+)
+
+// testProviders returns a memory and a file provider, the file one saves under dir
+func testProviders(dir string) map[string]session.Provider {
+	return map[string]session.Provider{
+		"memory": memory.NewProvider(),
+		"file":   file.NewProviderWithPath(dir),
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// serve run h under the Middleware of manager for a request carrying cookies
+func serve(manager *session.Manager, h http.HandlerFunc, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	manager.Middleware(h).ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddlewareSavesSession(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, provider := range testProviders(dir) {
+		manager, err := session.New(provider, session.WithGCLifetime(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+			session.FromContext(r.Context()).Set("user", "alice")
+		})
+		cookies := w.Result().Cookies()
+		if w.Code != http.StatusOK || len(cookies) != 1 {
+			t.Fatalf("%s: first request: status %d, cookies %v", name, w.Code, cookies)
+		}
+
+		var user interface{}
+		w = serve(manager, func(w http.ResponseWriter, r *http.Request) {
+			user = session.FromContext(r.Context()).Get("user")
+		}, cookies...)
+		if w.Code != http.StatusOK || user != "alice" {
+			t.Errorf("%s: second request: status %d, user %v", name, w.Code, user)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("%s: the existing session id is sent again", name)
+		}
+	}
+}
+
+func TestMiddlewareSkipsDestroyedSession(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, provider := range testProviders(dir) {
+		manager, err := session.New(provider, session.WithGCLifetime(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, change := range []bool{false, true} {
+			w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+				session.FromContext(r.Context()).Set("user", "alice")
+			})
+			cookies := w.Result().Cookies()
+			sid := cookies[0].Value
+
+			w = serve(manager, func(w http.ResponseWriter, r *http.Request) {
+				manager.SessionDestroy(w, r)
+				if change {
+					session.FromContext(r.Context()).Set("user", "bob")
+				}
+			}, cookies...)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: destroy (changed %v): status %d", name, change, w.Code)
+			}
+			if provider.SessionExist(sid) {
+				t.Errorf("%s: destroy (changed %v): the session is saved again", name, change)
+			}
+		}
+	}
+}
+
+func TestMiddlewareReleaseError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	var handled error
+	manager, err := session.New(file.NewProviderWithPath(dir),
+		session.WithGCLifetime(time.Hour),
+		session.WithReleaseErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			handled = err
+			w.WriteHeader(http.StatusTeapot)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		session.FromContext(r.Context()).Set("user", "alice")
+		// the session file can no longer be written
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if handled == nil || w.Code != http.StatusTeapot {
+		t.Fatalf("status %d, handled %v", w.Code, handled)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("the id of an unsaved session is sent")
+	}
+}
+
+func TestMiddlewareRegeneratedSession(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, provider := range testProviders(dir) {
+		manager, err := session.New(provider,
+			session.WithGCLifetime(time.Hour),
+			session.WithTimeouts(time.Hour, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+			session.FromContext(r.Context()).Set("user", "alice")
+		})
+		cookies := w.Result().Cookies()
+		oldSid := cookies[0].Value
+
+		for _, set := range []bool{false, true} {
+			var newSid string
+			w = serve(manager, func(w http.ResponseWriter, r *http.Request) {
+				session.FromContext(r.Context()).Set("cart", 1)
+				newSid = manager.SessionRegenerateID(w, r).SessionID()
+				if set {
+					session.FromContext(r.Context()).Set("role", "admin")
+				}
+			}, cookies...)
+			if provider.SessionExist(oldSid) {
+				t.Errorf("%s (set %v): the old session is saved again", name, set)
+			}
+			cookies = w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Value != newSid {
+				t.Fatalf("%s (set %v): cookies %v, want the regenerated id %s only", name, set, cookies, newSid)
+			}
+			st, err := manager.GetSessionStore(newSid)
+			if err != nil {
+				t.Fatalf("%s (set %v): %v", name, set, err)
+			}
+			if st.Get("user") != "alice" || st.Get("cart") != 1 || set && st.Get("role") != "admin" {
+				t.Errorf("%s (set %v): user %v, cart %v, role %v", name, set, st.Get("user"), st.Get("cart"), st.Get("role"))
+			}
+			oldSid = newSid
+		}
+	}
+}
+
+func TestMiddlewareRegeneratedNewSession(t *testing.T) {
+	provider := memory.NewProvider()
+	manager, err := session.New(provider, session.WithGCLifetime(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstSid, newSid string
+	w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		st := session.FromContext(r.Context())
+		firstSid = st.SessionID()
+		st.Set("user", "alice")
+		newSid = manager.SessionRegenerateID(w, r).SessionID()
+	})
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != newSid {
+		t.Fatalf("cookies %v, want the regenerated id %s only", cookies, newSid)
+	}
+	if provider.SessionExist(firstSid) {
+		t.Error("the session before regeneration is saved")
+	}
+	if st, err := manager.GetSessionStore(newSid); err != nil || st.Get("user") != "alice" {
+		t.Errorf("regenerated session: %v, %v", st, err)
+	}
+}
+
+func TestLazySession(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []session.Option
+		handler func(st store.Store)
+		stored  bool
+	}{
+		{"read only", nil, func(st store.Store) {}, false},
+		{"timeouts", []session.Option{session.WithTimeouts(time.Hour, time.Hour)},
+			func(st store.Store) {}, false},
+		{"set", []session.Option{session.WithTimeouts(time.Hour, 0)}, func(st store.Store) {
+			st.Set("user", "alice")
+			st.Set("role", "admin")
+		}, true},
+	}
+	for _, tt := range tests {
+		dir := tempDir(t)
+		for name, provider := range testProviders(dir) {
+			opts := append([]session.Option{session.WithGCLifetime(time.Hour), session.WithLazySession(true)}, tt.opts...)
+			manager, err := session.New(provider, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var created interface{}
+			w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+				st := session.FromContext(r.Context())
+				st.Get("user")
+				tt.handler(st)
+				w.Write([]byte("ok"))
+			})
+			cookies := w.Header()["Set-Cookie"]
+			all, err := provider.SessionAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.stored {
+				if len(cookies) != 0 || len(all) != 0 {
+					t.Errorf("%s, %s: cookies %v, stored %v, want none", tt.name, name, cookies, all)
+				}
+				continue
+			}
+			if len(cookies) != 1 || len(all) != 1 {
+				t.Fatalf("%s, %s: cookies %v, stored %v, want one", tt.name, name, cookies, all)
+			}
+			serve(manager, func(w http.ResponseWriter, r *http.Request) {
+				created = session.FromContext(r.Context()).Get(session.CreatedAtKey)
+			}, w.Result().Cookies()...)
+			if created == nil {
+				t.Errorf("%s, %s: the metadata of the lazy session is not saved", tt.name, name)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
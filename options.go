@@ -0,0 +1,416 @@
+package session
+
+import (
+	"github.com/misu99/session/codec"
+	"github.com/misu99/session/utils"
+	"time"
+)
+
+const (
+	// DefaultCookieName is the cookie name used by New if WithCookieName is not given
+	DefaultCookieName = "gosessionid"
+	// DefaultGclifetime is the gc interval used by New if WithGCLifetime is not given, in seconds
+	DefaultGclifetime = 3600
+	// DefaultSessionIDLength is the number of random bytes in a session id
+	DefaultSessionIDLength = 16
+)
+
+// Logger is used by the Manager to report errors it can not return,
+// *log.Logger and utils.Log satisfy it.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+// Option configures a Manager created by New.
+type Option func(manager *Manager)
+
+// New create a Manager on an already initialized provider instance,
+// unlike NewManager it never calls SessionInit, so the provider can be built
+// with preconfigured pools or be a test double.
+// if the provider has a SetLifetime(int64) method, it is called with the max lifetime.
+func New(provider Provider, opts ...Option) (*Manager, error) {
+	manager := &Manager{
+		provider: withContext(provider),
+		config: &ManagerConfig{
+			CookieName:      DefaultCookieName,
+			EnableSetCookie: true,
+			Gclifetime:      DefaultGclifetime,
+			SessionIDLength: DefaultSessionIDLength,
+		},
+		logger: utils.SLogger,
+
+		releaseErrorHandler: defaultReleaseErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(manager)
+	}
+
+	cf := manager.config
+	if err := cf.Validate(); err != nil {
+		return nil, err
+	}
+	if cf.Maxlifetime == 0 {
+		cf.Maxlifetime = cf.Gclifetime
+	}
+	if cf.SessionIDLength == 0 {
+		cf.SessionIDLength = DefaultSessionIDLength
+	}
+
+	var err error
+	if manager.trustedProxies, err = parseTrustedProxies(cf.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if manager.idGenerator == nil && cf.IDGenerator != "" {
+		if manager.idGenerator, err = NewIDGenerator(cf.IDGenerator, cf.SessionIDPrefix, int(cf.SessionIDLength)); err != nil {
+			return nil, err
+		}
+	}
+	if err = checkGenerator(manager.idGenerator); err != nil {
+		return nil, err
+	}
+
+	c := manager.codec
+	if c == nil && cf.Codec != "" {
+		if c, err = codec.Lookup(cf.Codec); err != nil {
+			return nil, err
+		}
+	}
+	compressor := manager.compressor
+	if compressor == nil && cf.Compression != "" {
+		if compressor, err = codec.LookupCompressor(cf.Compression); err != nil {
+			return nil, err
+		}
+	}
+	setLifetime(manager.provider, cf.Maxlifetime)
+	setCodec(manager.provider, c)
+	setCompression(manager.provider, compressor, cf.CompressThreshold)
+	setKeyring(manager.provider, manager.keyring)
+	if manager.providerMgr != nil {
+		setLifetime(manager.providerMgr, cf.Maxlifetime)
+		setCodec(manager.providerMgr, c)
+		setCompression(manager.providerMgr, compressor, cf.CompressThreshold)
+		setKeyring(manager.providerMgr, manager.keyring)
+	}
+	if cf.SlidingExpiration {
+		setReleaseRefresh(manager.provider, false)
+	}
+	if key := manager.sidHashKey(); key != nil {
+		manager.provider = hashSids(manager.provider, key)
+	}
+	return manager, nil
+}
+
+// unwrap returns the provider given to the Manager
+func unwrap(provider Provider) Provider {
+	if hp, ok := provider.(*hashedProvider); ok {
+		provider = hp.ContextProvider
+	}
+	if cp, ok := provider.(contextProvider); ok {
+		return cp.Provider
+	}
+	return provider
+}
+
+func setLifetime(provider Provider, lifetime int64) {
+	if ls, ok := unwrap(provider).(interface{ SetLifetime(int64) }); ok {
+		ls.SetLifetime(lifetime)
+	}
+}
+
+// setReleaseRefresh set whether the provider refreshes the unchanged sessions on release
+func setReleaseRefresh(provider Provider, refresh bool) {
+	if rs, ok := unwrap(provider).(interface{ SetReleaseRefresh(bool) }); ok {
+		rs.SetReleaseRefresh(refresh)
+	}
+}
+
+// setCodec apply c to the provider if it is persistent, nil keeps the provider default
+func setCodec(provider Provider, c codec.Codec) {
+	if c == nil {
+		return
+	}
+	if cs, ok := unwrap(provider).(interface{ SetCodec(codec.Codec) }); ok {
+		cs.SetCodec(c)
+	}
+}
+
+// setCompression apply c to the provider if it is persistent, nil keeps the payloads uncompressed
+func setCompression(provider Provider, c codec.Compressor, threshold int) {
+	if c == nil {
+		return
+	}
+	if cs, ok := unwrap(provider).(interface {
+		SetCompression(codec.Compressor, int)
+	}); ok {
+		cs.SetCompression(c, threshold)
+	}
+}
+
+// setKeyring apply k to the provider if it is persistent, nil keeps the payloads in plaintext
+func setKeyring(provider Provider, k *codec.Keyring) {
+	if k == nil {
+		return
+	}
+	if ks, ok := unwrap(provider).(interface{ SetKeyring(*codec.Keyring) }); ok {
+		ks.SetKeyring(k)
+	}
+}
+
+// WithConfig replace the whole config, options after it still apply.
+func WithConfig(cf ManagerConfig) Option {
+	return func(manager *Manager) {
+		manager.config = &cf
+	}
+}
+
+// WithCookieName set the name of the session cookie, it is also the url query name.
+func WithCookieName(name string) Option {
+	return func(manager *Manager) {
+		manager.config.CookieName = name
+	}
+}
+
+// WithMaxLifetime set how long a session lives in the provider.
+func WithMaxLifetime(d time.Duration) Option {
+	return func(manager *Manager) {
+		manager.config.Maxlifetime = int64(d / time.Second)
+	}
+}
+
+// WithGCLifetime set the interval of Manager.GC.
+func WithGCLifetime(d time.Duration) Option {
+	return func(manager *Manager) {
+		manager.config.Gclifetime = int64(d / time.Second)
+	}
+}
+
+// WithCookieLifetime set the max age of the session cookie, zero means a browser session cookie.
+func WithCookieLifetime(d time.Duration) Option {
+	return func(manager *Manager) {
+		manager.config.CookieLifeTime = int(d / time.Second)
+	}
+}
+
+// WithSetCookie set whether the Manager writes the session cookie to the response.
+func WithSetCookie(enable bool) Option {
+	return func(manager *Manager) {
+		manager.config.EnableSetCookie = enable
+	}
+}
+
+// WithTimeouts set the idle and absolute timeouts enforced by the Manager for every provider,
+// a session not accessed for idle, or created more than absolute ago, is treated as non-existent.
+// zero means no limit, sessions are still removed by the provider after Maxlifetime.
+func WithTimeouts(idle, absolute time.Duration) Option {
+	return func(manager *Manager) {
+		manager.config.IdleTimeout = int64(idle / time.Second)
+		manager.config.AbsoluteTimeout = int64(absolute / time.Second)
+	}
+}
+
+// WithSlidingExpiration make the Manager refresh the lifetime of the accessed sessions
+// for every provider. a session is written again only once fraction of its lifetime has
+// elapsed since the last refresh, 0 means DefaultRefreshFraction, releasing an unchanged
+// session does not touch the backend otherwise.
+func WithSlidingExpiration(fraction float64) Option {
+	return func(manager *Manager) {
+		manager.config.SlidingExpiration = true
+		manager.config.RefreshFraction = fraction
+	}
+}
+
+// WithDomain set the domain of the session cookie.
+func WithDomain(domain string) Option {
+	return func(manager *Manager) {
+		manager.config.Domain = domain
+	}
+}
+
+// WithSecure set the session cookie secure when the request is https.
+func WithSecure(secure bool) Option {
+	return func(manager *Manager) {
+		manager.config.Secure = secure
+	}
+}
+
+// WithHTTPOnly set whether the session cookie is HttpOnly, it is by default.
+func WithHTTPOnly(httpOnly bool) Option {
+	return func(manager *Manager) {
+		manager.config.DisableHTTPOnly = !httpOnly
+	}
+}
+
+// WithCookiePath set the path of the session cookie, it is / by default.
+func WithCookiePath(path string) Option {
+	return func(manager *Manager) {
+		manager.config.CookiePath = path
+	}
+}
+
+// WithSameSite set the SameSite attribute of the session cookie: lax, strict or none.
+func WithSameSite(mode string) Option {
+	return func(manager *Manager) {
+		manager.config.CookieSameSite = mode
+	}
+}
+
+// WithPartitioned set whether the session cookie is partitioned by top-level site (CHIPS),
+// it requires Secure.
+func WithPartitioned(partitioned bool) Option {
+	return func(manager *Manager) {
+		manager.config.CookiePartitioned = partitioned
+	}
+}
+
+// WithTrustedProxies honour the forwarded header of the proxies in cidrs, CIDRs or single IPs,
+// when they are the immediate peer: X-Forwarded-Proto and X-Forwarded-For by default,
+// Forwarded with header ProxyHeaderForwarded.
+func WithTrustedProxies(header string, cidrs ...string) Option {
+	return func(manager *Manager) {
+		manager.config.ProxyHeader = header
+		manager.config.TrustedProxies = cidrs
+	}
+}
+
+// WithSessionIDHeader read and write the session id in the http header name as well,
+// name must be in canonical form, such as "X-Session-Id".
+func WithSessionIDHeader(name string) Option {
+	return func(manager *Manager) {
+		manager.config.EnableSidInHTTPHeader = true
+		manager.config.SessionNameInHTTPHeader = name
+	}
+}
+
+// WithSessionIDInURLQuery read the session id from the url query as well,
+// the request body is not parsed for it.
+func WithSessionIDInURLQuery(enable bool) Option {
+	return func(manager *Manager) {
+		manager.config.EnableSidInURLQuery = enable
+	}
+}
+
+// WithSessionIDInAuthorization read the session id from the Authorization header as well,
+// as "<scheme> <sid>", an empty scheme means DefaultAuthorizationScheme.
+// with a SidSigner the token must be signed as well, hand out TokenValue(sid) rather than the bare id.
+func WithSessionIDInAuthorization(scheme string) Option {
+	return func(manager *Manager) {
+		manager.config.EnableSidInAuthorization = true
+		manager.config.AuthorizationScheme = scheme
+	}
+}
+
+// WithExtractors set the extractors finding the session id in a request, tried in order,
+// they replace the sources of the config. the session id is still sent by cookie and header.
+func WithExtractors(extractors ...Extractor) Option {
+	return func(manager *Manager) {
+		manager.extractors = extractors
+	}
+}
+
+// WithSidSources set the order the session id is looked for among SidSourceCookie,
+// SidSourceQuery, SidSourceHeader and SidSourceAuthorization, sources left out are not read.
+func WithSidSources(sources ...string) Option {
+	return func(manager *Manager) {
+		manager.config.SidSources = sources
+	}
+}
+
+// WithSessionIDLength set the number of random bytes of the default session id.
+func WithSessionIDLength(length int64) Option {
+	return func(manager *Manager) {
+		manager.config.SessionIDLength = length
+	}
+}
+
+// WithSessionIDPrefix set the prefix of the default session id.
+func WithSessionIDPrefix(prefix string) Option {
+	return func(manager *Manager) {
+		manager.config.SessionIDPrefix = prefix
+	}
+}
+
+// WithCodec set the codec the persistent providers encode session values with,
+// payloads written by other registered codecs can still be read.
+func WithCodec(c codec.Codec) Option {
+	return func(manager *Manager) {
+		manager.codec = c
+	}
+}
+
+// WithCompression compress the session values in the persistent providers by c once they are
+// encoded to threshold bytes or more, zero threshold means codec.DefaultCompressThreshold.
+// the compression is recorded in each payload, so reads do not depend on it.
+func WithCompression(c codec.Compressor, threshold int) Option {
+	return func(manager *Manager) {
+		manager.compressor = c
+		manager.config.CompressThreshold = threshold
+	}
+}
+
+// WithKeyring encrypt the session values in the persistent providers by the primary key of k,
+// payloads sealed by the other keys of k or written in plaintext can still be read,
+// Manager.Reencrypt rewrites them by the primary key.
+func WithKeyring(k *codec.Keyring) Option {
+	return func(manager *Manager) {
+		manager.keyring = k
+	}
+}
+
+// WithSidSigner sign the session ids in the cookie, header and url query by s,
+// ids without a valid signature are dropped before any provider call, from the
+// Authorization header too, the tokens of TokenStart are signed by TokenValue.
+func WithSidSigner(s *SidSigner) Option {
+	return func(manager *Manager) {
+		manager.sidSigner = s
+	}
+}
+
+// WithSidHashKey store the sessions in the provider under the HMAC-SHA256 of their id by key,
+// so that a dump of the backend holds no working session id. key must be at least
+// MinSidHashKeyLength bytes and must not change, or all the sessions are lost.
+func WithSidHashKey(key []byte) Option {
+	return func(manager *Manager) {
+		manager.config.SidHashKey = string(key)
+	}
+}
+
+// WithLazySession keep new sessions in memory until a value is set,
+// so that requests which never write the session cost no provider call and get no cookie.
+func WithLazySession(lazy bool) Option {
+	return func(manager *Manager) {
+		manager.config.LazySession = lazy
+	}
+}
+
+// WithIDGenerator replace the default session id generator, such as by UUIDGenerator,
+// ULIDGenerator or a custom one. it is used by SessionStart, TokenStart and SessionRegenerateID.
+// a zero Length of the built-in generators is DefaultSessionIDLength, New fails if it is
+// below MinSessionIDLength.
+func WithIDGenerator(generator IDGenerator) Option {
+	return func(manager *Manager) {
+		manager.idGenerator = generator
+	}
+}
+
+// WithLogger set the logger of the Manager, it defaults to utils.SLogger.
+func WithLogger(logger Logger) Option {
+	return func(manager *Manager) {
+		manager.logger = logger
+	}
+}
+
+// WithReleaseErrorHandler set how Manager.Middleware responds when the session can not be saved
+// before the handler has written the response, it replies 503 by default.
+func WithReleaseErrorHandler(handler ReleaseErrorHandler) Option {
+	return func(manager *Manager) {
+		manager.releaseErrorHandler = handler
+	}
+}
+
+// WithTokenMgrProvider set the provider keeping the user to token mapping of TokenMgrCreate.
+func WithTokenMgrProvider(provider Provider) Option {
+	return func(manager *Manager) {
+		manager.providerMgr = withContext(provider)
+	}
+}
@@ -0,0 +1,522 @@
+package cookie
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/misu99/session"
+	"github.com/misu99/session/codec"
+	"github.com/misu99/session/store"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCookieName is the name of the cookie carrying the session values
+	DefaultCookieName = "gosessiondata"
+	// DefaultMaxSize is the default max length of all the cookie values of a session
+	DefaultMaxSize = 8192
+	// ChunkSize is the max length of one cookie value, longer values are split
+	// into the cookies name, name_1, name_2 and so on, to stay under the 4KB browsers accept
+	ChunkSize = 3800
+)
+
+// ErrTooLarge is returned by SessionRelease when the sealed session does not fit in MaxSize
+var ErrTooLarge = errors.New("cookie: session is too large")
+
+var errUnbound = errors.New("cookie: sessions are only reachable through a request, use them by the Manager")
+
+// Config is the json config of the cookie provider, given to SessionInit.
+type Config struct {
+	CookieName string            `json:"cookieName"` // defaults to DefaultCookieName
+	Keys       map[string]string `json:"keys"`       // key id (0-255) to the base64 encoded AES key of 16, 24 or 32 bytes
+	PrimaryKey int               `json:"primaryKey"` // id of the key sealing new cookies, it can be omitted with a single key
+	MaxSize    int               `json:"maxSize"`    // defaults to DefaultMaxSize
+	// Domain, Path and Secure only apply without the Manager,
+	// which gives the cookies the attributes of its session cookie
+	Domain string `json:"domain"`
+	Path   string `json:"path"` // defaults to "/"
+	Secure bool   `json:"secure"`
+}
+
+// SessionStoreCookie cookie session store.
+// the values are sealed into the cookies of the response when it is released.
+type SessionStoreCookie struct {
+	pdr      *ProviderCookie
+	write    session.CookieWriter
+	sid      string
+	lock     sync.RWMutex
+	values   map[interface{}]interface{}
+	lifetime int64
+	expiry   int64 // unix time the sealed cookie expires, zero if not written yet
+	chunks   int   // number of cookies the client holds
+	dirty    bool  // values changed since the last release
+}
+
+// Set value to cookie session
+func (st *SessionStoreCookie) Set(key, value interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.values[key] = value
+	st.dirty = true
+	return nil
+}
+
+// Get value from cookie session
+func (st *SessionStoreCookie) Get(key interface{}) interface{} {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	if v, ok := st.values[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete value in cookie session
+func (st *SessionStoreCookie) Delete(key interface{}) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if _, ok := st.values[key]; ok && !store.IsMetadata(key) {
+		delete(st.values, key)
+		st.dirty = true
+	}
+	return nil
+}
+
+// Flush Clean all values in cookie session
+func (st *SessionStoreCookie) Flush() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	kept := store.KeepMetadata(st.values)
+	if len(kept) < len(st.values) {
+		st.values = kept
+		st.dirty = true
+	}
+	return nil
+}
+
+// SessionID Return id of this cookie session
+func (st *SessionStoreCookie) SessionID() string {
+	return st.sid
+}
+
+// Dirty reports whether the cookie session is written on release,
+// because a value changed or the expiry must be refreshed.
+func (st *SessionStoreCookie) Dirty() bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.dirty
+}
+
+// MarkDirty make the cookie session written on release, Set marks it already,
+// call it after changing a value in place, such as a map got by Get.
+func (st *SessionStoreCookie) MarkDirty() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.dirty = true
+}
+
+// SessionDelay refresh the expiry of the cookie on release
+func (st *SessionStoreCookie) SessionDelay() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.dirty = true
+}
+
+// SessionRelease seal the values into the cookies of the response,
+// it must be called before the response header is written.
+// a clean session is only written again once half of its lifetime has passed,
+// to refresh its expiry, a session without values removes its cookies.
+func (st *SessionStoreCookie) SessionRelease() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	now := time.Now().Unix()
+	if !st.dirty && st.expiry-now > st.lifetime/2 {
+		return nil
+	}
+	if len(st.values) == 0 {
+		st.pdr.removeChunks(st.write, 0, st.chunks)
+		st.chunks = 0
+		st.dirty = false
+		return nil
+	}
+
+	expiry := now + st.lifetime
+	value, err := st.pdr.seal(st.sid, expiry, st.values)
+	if err != nil {
+		return err
+	}
+	if len(value) > st.pdr.maxSize() {
+		return fmt.Errorf("%w: %d bytes sealed, the max size is %d", ErrTooLarge, len(value), st.pdr.maxSize())
+	}
+
+	n := 0
+	for ; len(value) > 0; n++ {
+		size := ChunkSize
+		if len(value) < size {
+			size = len(value)
+		}
+		st.write(st.pdr.chunkName(n), value[:size], int(st.lifetime))
+		value = value[size:]
+	}
+	st.pdr.removeChunks(st.write, n, st.chunks)
+	st.chunks = n
+	st.expiry = expiry
+	st.dirty = false
+	return nil
+}
+
+// SessionReleaseContext implement store.ContextStore, sealing the cookies makes no backend call
+func (st *SessionStoreCookie) SessionReleaseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return st.SessionRelease()
+}
+
+// SessionDelayContext implement store.ContextStore
+func (st *SessionStoreCookie) SessionDelayContext(ctx context.Context) {
+	st.SessionDelay()
+}
+
+// ProviderCookie cookie session provider.
+// it keeps no state, every session is sealed by AES-GCM into the cookies of its client,
+// the sealed data is bound to the session id and carries its own expiry.
+// it is a session.RequestProvider, its own methods do not reach any session.
+type ProviderCookie struct {
+	lifetime   int64
+	config     Config
+	keyring    *codec.Keyring
+	serializer codec.Serializer
+}
+
+// SessionInit Init cookie session provider with the json Config.
+// the keys are not needed if a keyring is set by SetKeyring.
+func (pdr *ProviderCookie) SessionInit(lifetime int64, config string) error {
+	pdr.lifetime = lifetime
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), &pdr.config); err != nil {
+			return err
+		}
+	}
+	if len(pdr.config.Keys) == 0 {
+		if pdr.keyring == nil {
+			return errors.New("cookie: no keys in the config")
+		}
+		return nil
+	}
+
+	keys := make(map[byte][]byte, len(pdr.config.Keys))
+	for id, encoded := range pdr.config.Keys {
+		n, err := strconv.ParseUint(id, 10, 8)
+		if err != nil {
+			return fmt.Errorf("cookie: key id %q is not in 0-255", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("cookie: key %s is not base64: %v", id, err)
+		}
+		keys[byte(n)] = key
+	}
+	primary := byte(pdr.config.PrimaryKey)
+	if len(keys) == 1 {
+		for id := range keys {
+			primary = id
+		}
+	}
+	if _, ok := keys[primary]; !ok {
+		return fmt.Errorf("cookie: primary key %d is not in the keys", pdr.config.PrimaryKey)
+	}
+
+	keyring, err := codec.NewKeyring(primary, keys[primary])
+	if err != nil {
+		return err
+	}
+	for id, key := range keys {
+		if id == primary {
+			continue
+		}
+		if err := keyring.Add(id, key); err != nil {
+			return err
+		}
+	}
+	pdr.keyring = keyring
+	return nil
+}
+
+// SetLifetime set the lifetime of sessions, in seconds
+func (pdr *ProviderCookie) SetLifetime(lifetime int64) {
+	pdr.lifetime = lifetime
+}
+
+// SetCodec set the codec encoding session values, it defaults to codec.Gob.
+// cookies written by other codecs can still be read.
+func (pdr *ProviderCookie) SetCodec(c codec.Codec) {
+	pdr.serializer.Codec = c
+}
+
+// SetCompression compress the session values by c once they are encoded to threshold bytes or more,
+// zero threshold means codec.DefaultCompressThreshold. Cookies written compressed or not can be read either way.
+func (pdr *ProviderCookie) SetCompression(c codec.Compressor, threshold int) {
+	pdr.serializer.Compressor = c
+	pdr.serializer.CompressThreshold = threshold
+}
+
+// SetKeyring seal the cookies by the primary key of k,
+// cookies sealed by the other keys of k can still be read.
+func (pdr *ProviderCookie) SetKeyring(k *codec.Keyring) {
+	pdr.keyring = k
+}
+
+// WithRequest returns the provider bound to one request, its sessions are read
+// from the cookies of r and written to the header of w with the Domain, Path and Secure of the Config.
+func (pdr *ProviderCookie) WithRequest(w http.ResponseWriter, r *http.Request) session.Provider {
+	return pdr.WithRequestCookies(w, r, func(name, value string, maxAge int) {
+		http.SetCookie(w, pdr.cookie(name, value, maxAge))
+	})
+}
+
+// WithRequestCookies returns the provider bound to one request, its sessions are read
+// from the cookies of r and written by write. the Manager calls it with the attributes
+// of its session cookie, the Domain, Path and Secure of the Config are then not used.
+func (pdr *ProviderCookie) WithRequestCookies(w http.ResponseWriter, r *http.Request, write session.CookieWriter) session.Provider {
+	return &requestProvider{pdr: pdr, write: write, r: r}
+}
+
+// SessionNew is not supported, cookie sessions need a request
+func (pdr *ProviderCookie) SessionNew(sid string, lifetime int64) (store.Store, error) {
+	return nil, errUnbound
+}
+
+// SessionRead is not supported, cookie sessions need a request
+func (pdr *ProviderCookie) SessionRead(sid string) (store.Store, error) {
+	return nil, errUnbound
+}
+
+// SessionExist is always false, cookie sessions need a request
+func (pdr *ProviderCookie) SessionExist(sid string) bool {
+	return false
+}
+
+// SessionRegenerate is not supported, cookie sessions need a request
+func (pdr *ProviderCookie) SessionRegenerate(oldSid, sid string) (store.Store, error) {
+	return nil, errUnbound
+}
+
+// SessionDestroy is not supported, cookie sessions need a request
+func (pdr *ProviderCookie) SessionDestroy(sid string) error {
+	return errUnbound
+}
+
+// SessionAll is not supported, the sessions are only known by their clients
+func (pdr *ProviderCookie) SessionAll() ([]string, error) {
+	return nil, errors.New("cookie: sessions are kept by the clients and can not be listed")
+}
+
+// SessionGC Implement method, no used.
+func (pdr *ProviderCookie) SessionGC() {
+}
+
+func (pdr *ProviderCookie) name() string {
+	if pdr.config.CookieName == "" {
+		return DefaultCookieName
+	}
+	return pdr.config.CookieName
+}
+
+func (pdr *ProviderCookie) maxSize() int {
+	if pdr.config.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return pdr.config.MaxSize
+}
+
+// chunkName returns the name of the cookie carrying chunk i of the sealed session
+func (pdr *ProviderCookie) chunkName(i int) string {
+	if i == 0 {
+		return pdr.name()
+	}
+	return pdr.name() + "_" + strconv.Itoa(i)
+}
+
+// cookie build the cookie name by the Config, for a provider bound without the Manager
+func (pdr *ProviderCookie) cookie(name, value string, maxAge int) *http.Cookie {
+	path := pdr.config.Path
+	if path == "" {
+		path = "/"
+	}
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   pdr.config.Domain,
+		Secure:   pdr.config.Secure,
+		HttpOnly: true,
+	}
+	switch {
+	case maxAge < 0:
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(0, 0)
+	case maxAge > 0:
+		cookie.MaxAge = maxAge
+		cookie.Expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	}
+	return cookie
+}
+
+// removeChunks expire the cookies of chunks from to the end
+func (pdr *ProviderCookie) removeChunks(write session.CookieWriter, from, end int) {
+	for i := from; i < end; i++ {
+		write(pdr.chunkName(i), "", -1)
+	}
+}
+
+// additionalData binds the sealed values to the cookie name and the session id,
+// so that they can not be replayed under another session.
+func (pdr *ProviderCookie) additionalData(sid string) []byte {
+	return []byte(pdr.name() + "\x00" + sid)
+}
+
+// seal encode and encrypt values, the cookie value is
+// base64url(key id, nonce, sealed(8 bytes expiry, payload))
+func (pdr *ProviderCookie) seal(sid string, expiry int64, values map[interface{}]interface{}) (string, error) {
+	if pdr.keyring == nil {
+		return "", errors.New("cookie: no key, set keys in the config or a keyring")
+	}
+	payload, err := pdr.serializer.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint64(plaintext, uint64(expiry))
+	plaintext = append(plaintext, payload...)
+
+	keyID := pdr.keyring.Primary()
+	sealed, err := pdr.keyring.Seal([]byte{keyID}, keyID, plaintext, pdr.additionalData(sid))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open read the session sid from the cookies of r, ok is false if r carries no valid,
+// unexpired session sid. chunks is the number of cookies r carries.
+func (pdr *ProviderCookie) open(r *http.Request, sid string) (values map[interface{}]interface{}, expiry int64, chunks int, ok bool) {
+	var value string
+	for ; ; chunks++ {
+		cookie, err := r.Cookie(pdr.chunkName(chunks))
+		if err != nil {
+			break
+		}
+		value += cookie.Value
+	}
+	if value == "" || pdr.keyring == nil {
+		return nil, 0, chunks, false
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < 1 {
+		return nil, 0, chunks, false
+	}
+	plaintext, err := pdr.keyring.Open(sealed[0], sealed[1:], pdr.additionalData(sid))
+	if err != nil || len(plaintext) < 8 {
+		return nil, 0, chunks, false
+	}
+	expiry = int64(binary.BigEndian.Uint64(plaintext))
+	if expiry <= time.Now().Unix() {
+		return nil, 0, chunks, false
+	}
+	values, _, err = pdr.serializer.Unmarshal(plaintext[8:])
+	if err != nil {
+		return nil, 0, chunks, false
+	}
+	if sealed[0] != pdr.keyring.Primary() {
+		expiry = 0 // sealed by an old key, written again on release
+	}
+	return values, expiry, chunks, true
+}
+
+// requestProvider is the cookie provider bound to one request
+type requestProvider struct {
+	pdr   *ProviderCookie
+	write session.CookieWriter
+	r     *http.Request
+}
+
+func (rp *requestProvider) SessionInit(lifetime int64, config string) error {
+	return rp.pdr.SessionInit(lifetime, config)
+}
+
+// SessionNew create the cookie session sid, it keeps the values the request already carries
+func (rp *requestProvider) SessionNew(sid string, lifetime int64) (store.Store, error) {
+	if lifetime == 0 {
+		lifetime = rp.pdr.lifetime
+	}
+	values, expiry, chunks, ok := rp.pdr.open(rp.r, sid)
+	if !ok {
+		values = make(map[interface{}]interface{})
+	}
+	return &SessionStoreCookie{pdr: rp.pdr, write: rp.write, sid: sid, values: values, lifetime: lifetime, expiry: expiry, chunks: chunks}, nil
+}
+
+// SessionRead read the cookie session sid from the request
+func (rp *requestProvider) SessionRead(sid string) (store.Store, error) {
+	values, expiry, chunks, ok := rp.pdr.open(rp.r, sid)
+	if !ok {
+		return nil, errors.New("the sid's session not found")
+	}
+	return &SessionStoreCookie{pdr: rp.pdr, write: rp.write, sid: sid, values: values, lifetime: rp.pdr.lifetime, expiry: expiry, chunks: chunks}, nil
+}
+
+// SessionExist check the request carries the cookie session sid
+func (rp *requestProvider) SessionExist(sid string) bool {
+	_, _, _, ok := rp.pdr.open(rp.r, sid)
+	return ok
+}
+
+// SessionRegenerate move the values of the cookie session oldSid to sid,
+// the cookies are sealed again for sid on release
+func (rp *requestProvider) SessionRegenerate(oldSid, sid string) (store.Store, error) {
+	values, _, chunks, ok := rp.pdr.open(rp.r, oldSid)
+	if !ok {
+		values = make(map[interface{}]interface{})
+	}
+	return &SessionStoreCookie{pdr: rp.pdr, write: rp.write, sid: sid, values: values, lifetime: rp.pdr.lifetime, chunks: chunks, dirty: true}, nil
+}
+
+// SessionDestroy remove the cookies of the session from the client
+func (rp *requestProvider) SessionDestroy(sid string) error {
+	_, _, chunks, _ := rp.pdr.open(rp.r, sid)
+	rp.pdr.removeChunks(rp.write, 0, chunks)
+	return nil
+}
+
+func (rp *requestProvider) SessionAll() ([]string, error) {
+	return rp.pdr.SessionAll()
+}
+
+func (rp *requestProvider) SessionGC() {
+}
+
+func init() {
+	session.Register("cookie", func() session.Provider {
+		return NewProvider()
+	})
+}
+
+// NewProvider create a new cookie session provider, its keys are set by SessionInit
+func NewProvider() *ProviderCookie {
+	return &ProviderCookie{}
+}
+
+// NewProviderWithKeyring create a cookie session provider sealing the cookies by k.
+// use it with session.New, the lifetime is set by the Manager.
+func NewProviderWithKeyring(k *codec.Keyring, cf Config) *ProviderCookie {
+	return &ProviderCookie{config: cf, keyring: k}
+}
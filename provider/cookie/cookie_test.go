@@ -0,0 +1,106 @@
+package cookie
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/codec"
+)
+
+func testManager(t *testing.T, opts ...session.Option) *session.Manager {
+	k, err := codec.NewKeyring(1, bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]session.Option{session.WithGCLifetime(time.Hour)}, opts...)
+	manager, err := session.New(NewProviderWithKeyring(k, Config{}), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// serve run h under the Middleware of manager for a request carrying cookies
+func serve(manager *session.Manager, h http.HandlerFunc, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	manager.Middleware(h).ServeHTTP(w, r)
+	return w
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	manager := testManager(t)
+	note := strings.Repeat("x", ChunkSize+ChunkSize/2)
+	w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		st := session.FromContext(r.Context())
+		st.Set("user", "alice")
+		st.Set("note", note)
+	})
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) < 3 {
+		t.Fatalf("status %d, cookies %v", w.Code, cookies)
+	}
+
+	var user, got interface{}
+	serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		st := session.FromContext(r.Context())
+		user, got = st.Get("user"), st.Get("note")
+	}, cookies...)
+	if user != "alice" || got != note {
+		t.Errorf("user %v, note of %d bytes", user, len(got.(string)))
+	}
+}
+
+func TestCookieTampered(t *testing.T) {
+	manager := testManager(t)
+	w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		session.FromContext(r.Context()).Set("user", "alice")
+	})
+	cookies := w.Result().Cookies()
+	for _, c := range cookies {
+		if c.Name == DefaultCookieName {
+			flipped := byte('A')
+			if c.Value[10] == flipped {
+				flipped = 'B'
+			}
+			c.Value = c.Value[:10] + string(flipped) + c.Value[11:]
+		}
+	}
+	var user interface{}
+	serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		user = session.FromContext(r.Context()).Get("user")
+	}, cookies...)
+	if user != nil {
+		t.Errorf("a tampered cookie is read: user %v", user)
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	manager := testManager(t,
+		session.WithSecure(true),
+		session.WithCookiePath("/app"),
+		session.WithSameSite("strict"),
+		session.WithPartitioned(true))
+	w := serve(manager, func(w http.ResponseWriter, r *http.Request) {
+		session.FromContext(r.Context()).Set("user", "alice")
+	})
+	headers := w.Result().Header["Set-Cookie"]
+	if len(headers) != 2 {
+		t.Fatalf("Set-Cookie = %v", headers)
+	}
+	for _, h := range headers {
+		for _, attr := range []string{"Path=/app", "SameSite=Strict", "Secure", "HttpOnly", "Partitioned"} {
+			if !strings.Contains(h, attr) {
+				t.Errorf("%q has no %s", h, attr)
+			}
+		}
+	}
+}
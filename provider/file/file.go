@@ -15,7 +15,10 @@
 package file
 
 import (
+	"context"
 	"errors"
+	"github.com/misu99/session"
+	"github.com/misu99/session/codec"
 	"github.com/misu99/session/store"
 	"github.com/misu99/session/utils"
 	"io/ioutil"
@@ -27,16 +30,14 @@ import (
 	"time"
 )
 
-var (
-	filePdr    = &ProviderFile{}
-	gcLifeTime int64
-)
-
 // SessionStoreFile File session store
 type SessionStoreFile struct {
-	sid    string
-	lock   sync.RWMutex
-	values map[interface{}]interface{}
+	pdr      *ProviderFile
+	sid      string
+	lock     sync.RWMutex
+	values   map[interface{}]interface{}
+	dirty    bool  // values changed since the last release
+	lifetime int64 // lifetime of the session in seconds, 0 for the provider lifetime
 }
 
 // Set value to file session
@@ -44,6 +45,7 @@ func (st *SessionStoreFile) Set(key, value interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	st.values[key] = value
+	st.dirty = true
 	return nil
 }
 
@@ -61,7 +63,10 @@ func (st *SessionStoreFile) Get(key interface{}) interface{} {
 func (st *SessionStoreFile) Delete(key interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	delete(st.values, key)
+	if _, ok := st.values[key]; ok && !store.IsMetadata(key) {
+		delete(st.values, key)
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -69,7 +74,11 @@ func (st *SessionStoreFile) Delete(key interface{}) error {
 func (st *SessionStoreFile) Flush() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	st.values = make(map[interface{}]interface{})
+	kept := store.KeepMetadata(st.values)
+	if len(kept) < len(st.values) {
+		st.values = kept
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -78,47 +87,109 @@ func (st *SessionStoreFile) SessionID() string {
 	return st.sid
 }
 
-// SessionDelay Implement method, no used.
+// Lifetime returns the lifetime of the file session in seconds
+func (st *SessionStoreFile) Lifetime() int64 {
+	return st.pdr.lifetimeOf(st.lifetime)
+}
+
+// Dirty reports whether the file session is written on release,
+// because a value changed or the stored payload is stale.
+func (st *SessionStoreFile) Dirty() bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.dirty
+}
+
+// MarkDirty make the file session written on release, Set marks it already,
+// call it after changing a value in place, such as a map got by Get.
+func (st *SessionStoreFile) MarkDirty() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.dirty = true
+}
+
+// SessionDelay extend the session by refreshing the file times
 func (st *SessionStoreFile) SessionDelay() {
+	st.pdr.lock.Lock()
+	defer st.pdr.lock.Unlock()
+	now := time.Now()
+	if err := os.Chtimes(path.Join(st.pdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid), now, now); err != nil {
+		utils.SLogger.Println(err)
+	}
 }
 
-// SessionRelease Write file session to local file with Gob string
-func (st *SessionStoreFile) SessionRelease() {
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
-	b, err := utils.EncodeGob(st.values)
+// SessionRelease Write file session to local file with Gob string.
+// if no value changed, only the file times are refreshed, unless SetReleaseRefresh turned it off.
+func (st *SessionStoreFile) SessionRelease() error {
+	st.pdr.lock.Lock()
+	defer st.pdr.lock.Unlock()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if !st.dirty {
+		if st.pdr.skipRefresh {
+			return nil
+		}
+		err := os.Chtimes(path.Join(st.pdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid), time.Now(), time.Now())
+		if os.IsNotExist(err) {
+			// destroyed meanwhile, there is nothing to refresh
+			return nil
+		}
+		return err
+	}
+
+	b, err := st.pdr.serializer.Marshal(st.values)
 	if err != nil {
-		utils.SLogger.Println(err)
-		return
+		return err
 	}
-	_, err = os.Stat(path.Join(filePdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid))
+	b = encodeFile(st.lifetime, b)
+	_, err = os.Stat(path.Join(st.pdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid))
 	var f *os.File
 	if err == nil {
-		f, err = os.OpenFile(path.Join(filePdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid), os.O_RDWR, 0777)
+		f, err = os.OpenFile(path.Join(st.pdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid), os.O_RDWR, 0777)
 		if err != nil {
-			utils.SLogger.Println(err)
-			return
+			return err
 		}
 	} else if os.IsNotExist(err) {
-		f, err = os.Create(path.Join(filePdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid))
+		f, err = os.Create(path.Join(st.pdr.savePath, string(st.sid[0]), string(st.sid[1]), st.sid))
 		if err != nil {
-			utils.SLogger.Println(err)
-			return
+			return err
 		}
 	} else {
-		return
+		return err
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.Write(b)
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
 	}
-	_ = f.Truncate(0)
-	_, _ = f.Seek(0, 0)
-	_, _ = f.Write(b)
-	_ = f.Close()
+	st.dirty = false
+	return nil
+}
+
+// checkSid reject the sids which can not name a session file,
+// the file of sid is savePath/sid[0]/sid[1]/sid
+func checkSid(sid string) error {
+	if len(sid) < 2 {
+		return errors.New("length of the sid is less than 2")
+	}
+	if strings.ContainsAny(sid, "./\\\x00") {
+		return errors.New("the sid contains a path character")
+	}
+	return nil
 }
 
 // ProviderFile File session provider
 type ProviderFile struct {
-	lock     sync.RWMutex
-	lifeTime int64
-	savePath string
+	lock        sync.RWMutex
+	lifeTime    int64
+	savePath    string
+	serializer  codec.Serializer
+	skipRefresh bool // releasing an unchanged session does not refresh it
 }
 
 // SessionInit Init file session provider.
@@ -129,32 +200,65 @@ func (pdr *ProviderFile) SessionInit(lifetime int64, savePath string) error {
 	return nil
 }
 
+// SetCodec set the codec encoding session values, it defaults to codec.Gob.
+// files written by other codecs can still be read.
+func (pdr *ProviderFile) SetCodec(c codec.Codec) {
+	pdr.serializer.Codec = c
+}
+
+// SetCompression compress the session values by c once they are encoded to threshold bytes or more,
+// zero threshold means codec.DefaultCompressThreshold. Files written compressed or not can be read either way.
+func (pdr *ProviderFile) SetCompression(c codec.Compressor, threshold int) {
+	pdr.serializer.Compressor = c
+	pdr.serializer.CompressThreshold = threshold
+}
+
+// SetKeyring encrypt the session files by the primary key of k,
+// files sealed by the other keys of k or not encrypted can still be read.
+func (pdr *ProviderFile) SetKeyring(k *codec.Keyring) {
+	pdr.serializer.Keyring = k
+}
+
+// SetLifetime set the lifetime of sessions, in seconds
+func (pdr *ProviderFile) SetLifetime(lifetime int64) {
+	pdr.lifeTime = lifetime
+}
+
+// SetReleaseRefresh set whether reading or releasing an unchanged session refreshes
+// the file times, it does by default. the Manager turns it off when it manages the sliding expiration.
+func (pdr *ProviderFile) SetReleaseRefresh(refresh bool) {
+	pdr.skipRefresh = !refresh
+}
+
 // create new file session by sid.
 // if file is not exist, create it.
 // the file path is generated from sid string.
+// lifetime is the lifetime of the session in seconds, 0 for the provider lifetime,
+// an existing session keeps its own.
 func (pdr *ProviderFile) SessionNew(sid string, lifetime int64) (store.Store, error) {
-	if strings.ContainsAny(sid, "./") {
-		return nil, nil
-	}
-	if len(sid) < 2 {
-		return nil, errors.New("length of the sid is less than 2")
+	if err := checkSid(sid); err != nil {
+		return nil, err
 	}
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
 
 	err := os.MkdirAll(path.Join(pdr.savePath, string(sid[0]), string(sid[1])), 0777)
 	if err != nil {
 		utils.SLogger.Println(err.Error())
 	}
-	_, err = os.Stat(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid))
+	file := path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid)
+	info, err := os.Stat(file)
 	var f *os.File
 	if err == nil {
-		f, err = os.OpenFile(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid), os.O_RDWR, 0777)
+		f, err = os.OpenFile(file, os.O_RDWR, 0777)
 	} else if os.IsNotExist(err) {
-		f, err = os.Create(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid))
+		f, err = os.Create(file)
 	} else {
 		return nil, err
 	}
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		err := f.Close()
 		if err != nil {
@@ -162,101 +266,127 @@ func (pdr *ProviderFile) SessionNew(sid string, lifetime int64) (store.Store, er
 		}
 	}()
 
-	_ = os.Chtimes(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid), time.Now(), time.Now())
 	var kv map[interface{}]interface{}
+	var stale bool
 	b, err := ioutil.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
-	if len(b) == 0 {
+	stored, payload, err := decodeFile(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 || (info != nil && pdr.expired(info.ModTime(), stored)) {
+		// a new session, or an expired one the gc has not removed yet
+		if err = f.Truncate(0); err == nil {
+			_, err = f.WriteAt(encodeFile(lifetime, nil), 0)
+		}
+		if err != nil {
+			return nil, err
+		}
 		kv = make(map[interface{}]interface{})
 	} else {
-		kv, err = utils.DecodeGob(b)
-		if err != nil {
+		lifetime = stored
+		if len(payload) == 0 {
+			kv = make(map[interface{}]interface{})
+		} else if kv, stale, err = pdr.serializer.Unmarshal(payload); err != nil {
 			return nil, err
 		}
 	}
+	_ = os.Chtimes(file, time.Now(), time.Now())
 
-	ss := &SessionStoreFile{sid: sid, values: kv}
+	ss := &SessionStoreFile{pdr: pdr, sid: sid, values: kv, dirty: stale, lifetime: lifetime}
 	return ss, nil
 }
 
 // SessionRead Read file session by sid.
 // the file path is generated from sid string.
 func (pdr *ProviderFile) SessionRead(sid string) (store.Store, error) {
-	if strings.ContainsAny(sid, "./") {
-		return nil, nil
-	}
-	if len(sid) < 2 {
-		return nil, errors.New("length of the sid is less than 2")
+	return pdr.read(sid, !pdr.skipRefresh)
+}
+
+// SessionPeek Read file session by sid without refreshing it.
+func (pdr *ProviderFile) SessionPeek(sid string) (store.Store, error) {
+	return pdr.read(sid, false)
+}
+
+// read the session file of sid, refresh its modification time if refresh is set
+func (pdr *ProviderFile) read(sid string, refresh bool) (store.Store, error) {
+	if err := checkSid(sid); err != nil {
+		return nil, err
 	}
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
 
-	err := os.MkdirAll(path.Join(pdr.savePath, string(sid[0]), string(sid[1])), 0777)
+	file := path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid)
+	info, err := os.Stat(file)
 	if err != nil {
-		utils.SLogger.Println(err.Error())
+		return nil, err
 	}
-	_, err = os.Stat(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid))
-	var f *os.File
-	if err == nil {
-		f, err = os.OpenFile(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid), os.O_RDWR, 0777)
-		//} else if os.IsNotExist(err) {
-		//	f, err = os.Create(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid))
-	} else {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		err := f.Close()
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-	}()
-
-	_ = os.Chtimes(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid), time.Now(), time.Now())
-	var kv map[interface{}]interface{}
-	b, err := ioutil.ReadAll(f)
+	lifetime, payload, err := decodeFile(b)
 	if err != nil {
 		return nil, err
 	}
-	if len(b) == 0 {
+	if pdr.expired(info.ModTime(), lifetime) {
+		return nil, errors.New("the sid's session is expired")
+	}
+	if refresh {
+		_ = os.Chtimes(file, time.Now(), time.Now())
+	}
+
+	var kv map[interface{}]interface{}
+	var stale bool
+	if len(payload) == 0 {
 		kv = make(map[interface{}]interface{})
-	} else {
-		kv, err = utils.DecodeGob(b)
-		if err != nil {
-			return nil, err
-		}
+	} else if kv, stale, err = pdr.serializer.Unmarshal(payload); err != nil {
+		return nil, err
 	}
 
-	ss := &SessionStoreFile{sid: sid, values: kv}
+	ss := &SessionStoreFile{pdr: pdr, sid: sid, values: kv, dirty: stale, lifetime: lifetime}
 	return ss, nil
 }
 
 // SessionExist Check file session exist.
 // it checks the file named from sid exist or not.
 func (pdr *ProviderFile) SessionExist(sid string) bool {
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
+	if checkSid(sid) != nil {
+		return false
+	}
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
 
-	_, err := os.Stat(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid))
-	return err == nil
+	file := path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid)
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	lifetime, err := readLifetime(file)
+	return err == nil && !pdr.expired(info.ModTime(), lifetime)
 }
 
 // SessionDestroy Remove all files in this save path
 func (pdr *ProviderFile) SessionDestroy(sid string) error {
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
+	if err := checkSid(sid); err != nil {
+		return err
+	}
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
 	_ = os.Remove(path.Join(pdr.savePath, string(sid[0]), string(sid[1]), sid))
 	return nil
 }
 
 // SessionGC Recycle files in save path
 func (pdr *ProviderFile) SessionGC() {
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
 
-	gcLifeTime = pdr.lifeTime
-	_ = filepath.Walk(pdr.savePath, gcDir)
+	_ = filepath.Walk(pdr.savePath, func(path string, info os.FileInfo, err error) error {
+		return pdr.gcFile(path, info, err)
+	})
 }
 
 // SessionAll id values in mysql session
@@ -275,8 +405,14 @@ func (pdr *ProviderFile) SessionAll() ([]string, error) {
 // SessionRegenerate Generate new sid for file session.
 // it delete old file and create new file named from new sid.
 func (pdr *ProviderFile) SessionRegenerate(oldSid, sid string) (store.Store, error) {
-	filePdr.lock.Lock()
-	defer filePdr.lock.Unlock()
+	if err := checkSid(oldSid); err != nil {
+		return nil, err
+	}
+	if err := checkSid(sid); err != nil {
+		return nil, err
+	}
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
 
 	oldPath := path.Join(pdr.savePath, string(oldSid[0]), string(oldSid[1]))
 	oldSidFile := path.Join(oldPath, oldSid)
@@ -299,18 +435,28 @@ func (pdr *ProviderFile) SessionRegenerate(oldSid, sid string) (store.Store, err
 	// 2.write content to new sid file
 	// 3.remove old sid file, change new sid file atime and ctime
 	// 4.return SessionStoreFile
-	_, err = os.Stat(oldSidFile)
+	info, err := os.Stat(oldSidFile)
 	if err == nil {
 		b, err := ioutil.ReadFile(oldSidFile)
 		if err != nil {
 			return nil, err
 		}
 
+		lifetime, payload, err := decodeFile(b)
+		if err != nil {
+			return nil, err
+		}
+		if pdr.expired(info.ModTime(), lifetime) {
+			// expired but not collected yet, the new session starts empty
+			_ = os.Remove(oldSidFile)
+			return pdr.createRegenerated(newSidFile, sid)
+		}
 		var kv map[interface{}]interface{}
-		if len(b) == 0 {
+		var stale bool
+		if len(payload) == 0 {
 			kv = make(map[interface{}]interface{})
 		} else {
-			kv, err = utils.DecodeGob(b)
+			kv, stale, err = pdr.serializer.Unmarshal(payload)
 			if err != nil {
 				return nil, err
 			}
@@ -322,29 +468,38 @@ func (pdr *ProviderFile) SessionRegenerate(oldSid, sid string) (store.Store, err
 		}
 
 		_ = os.Chtimes(newSidFile, time.Now(), time.Now())
-		ss := &SessionStoreFile{sid: sid, values: kv}
+		ss := &SessionStoreFile{pdr: pdr, sid: sid, values: kv, dirty: stale, lifetime: lifetime}
 		return ss, nil
 	}
 
 	// if old sid file not exist, just create new sid file and return
+	return pdr.createRegenerated(newSidFile, sid)
+}
+
+// createRegenerated create the empty file of a regenerated session without an old one
+func (pdr *ProviderFile) createRegenerated(newSidFile, sid string) (store.Store, error) {
 	newf, err := os.Create(newSidFile)
 	if err != nil {
 		return nil, err
 	}
 	_ = newf.Close()
-	ss := &SessionStoreFile{sid: sid, values: make(map[interface{}]interface{})}
+	ss := &SessionStoreFile{pdr: pdr, sid: sid, values: make(map[interface{}]interface{})}
 	return ss, nil
 }
 
-// remove file in save path if expired
-func gcDir(path string, info os.FileInfo, err error) error {
+// remove file in save path if expired, by the lifetime in its header
+func (pdr *ProviderFile) gcFile(path string, info os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
 	if info.IsDir() {
 		return nil
 	}
-	if (info.ModTime().Unix() + gcLifeTime) < time.Now().Unix() {
+	lifetime, err := readLifetime(path)
+	if err != nil {
+		lifetime = 0
+	}
+	if pdr.expired(info.ModTime(), lifetime) {
 		_ = os.Remove(path)
 	}
 	return nil
@@ -367,10 +522,83 @@ func (as *activeSession) visit(paths string, f os.FileInfo, err error) error {
 	return nil
 }
 
-//func init() {
-//	session.Register("file", filePdr)
-//}
+// SessionDelayContext is SessionDelay, it returns early if ctx is done
+func (st *SessionStoreFile) SessionDelayContext(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	st.SessionDelay()
+}
+
+// SessionReleaseContext is SessionRelease, it returns early if ctx is done
+func (st *SessionStoreFile) SessionReleaseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return st.SessionRelease()
+}
+
+// SessionNewContext is SessionNew, it fails early if ctx is done
+func (pdr *ProviderFile) SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionNew(sid, lifetime)
+}
+
+// SessionReadContext is SessionRead, it fails early if ctx is done
+func (pdr *ProviderFile) SessionReadContext(ctx context.Context, sid string) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionRead(sid)
+}
 
+// SessionExistContext is SessionExist, it reports false if ctx is done
+func (pdr *ProviderFile) SessionExistContext(ctx context.Context, sid string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return pdr.SessionExist(sid)
+}
+
+// SessionRegenerateContext is SessionRegenerate, it fails early if ctx is done
+func (pdr *ProviderFile) SessionRegenerateContext(ctx context.Context, oldSid, sid string) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionRegenerate(oldSid, sid)
+}
+
+// SessionDestroyContext is SessionDestroy, it fails early if ctx is done
+func (pdr *ProviderFile) SessionDestroyContext(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pdr.SessionDestroy(sid)
+}
+
+// SessionAllContext is SessionAll, it fails early if ctx is done
+func (pdr *ProviderFile) SessionAllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionAll()
+}
+
+func init() {
+	session.Register("file", func() session.Provider {
+		return NewProvider()
+	})
+}
+
+// NewProvider create a new file session provider
 func NewProvider() *ProviderFile {
-	return filePdr
+	return &ProviderFile{}
+}
+
+// NewProviderWithPath create a file session provider saving files in savePath.
+// use it with session.New, the lifetime is set by the Manager.
+func NewProviderWithPath(savePath string) *ProviderFile {
+	return &ProviderFile{savePath: savePath}
 }
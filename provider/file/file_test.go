@@ -0,0 +1,49 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRegenerateExpiredFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pdr := NewProvider()
+	_ = pdr.SessionInit(60, dir)
+
+	for _, expired := range []bool{false, true} {
+		st, err := pdr.SessionNew("oldsid", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Set("user", "alice")
+		if err := st.SessionRelease(); err != nil {
+			t.Fatal(err)
+		}
+		oldFile := path.Join(dir, "o", "l", "oldsid")
+		if expired {
+			past := time.Now().Add(-time.Hour)
+			_ = os.Chtimes(oldFile, past, past)
+		}
+
+		if st, err = pdr.SessionRegenerate("oldsid", "newsid"); err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Get("user"); (got == nil) != expired {
+			t.Errorf("expired %v: regenerated session has user %v", expired, got)
+		}
+		if _, err := os.Stat(oldFile); !os.IsNotExist(err) {
+			t.Errorf("expired %v: old session file is kept", expired)
+		}
+		if !pdr.SessionExist("newsid") {
+			t.Errorf("expired %v: regenerated session does not exist", expired)
+		}
+		_ = pdr.SessionDestroy("newsid")
+	}
+}
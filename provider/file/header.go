@@ -0,0 +1,81 @@
+package file
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// a session file with its own lifetime starts with the metadata header:
+//
+//	0x00, 0xff, header version, uvarint lifetime in seconds
+//
+// followed by the payload. the payloads start with 0x00 and a format below 0xff,
+// or with a gob stream which never starts with 0x00, so the files without
+// header, those of the provider lifetime, are told apart and stay as they were.
+const (
+	headerMagic   = 0x00
+	headerMarker  = 0xff
+	headerVersion = 1
+
+	maxHeaderLength = 3 + binary.MaxVarintLen64
+)
+
+// encodeFile returns the content of a session file, payload is written as is if lifetime is 0
+func encodeFile(lifetime int64, payload []byte) []byte {
+	if lifetime == 0 {
+		return payload
+	}
+	b := make([]byte, 3, maxHeaderLength+len(payload))
+	b[0], b[1], b[2] = headerMagic, headerMarker, headerVersion
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(lifetime))
+	b = append(b, buf[:n]...)
+	return append(b, payload...)
+}
+
+// decodeFile split the content of a session file into its lifetime, 0 without header, and payload
+func decodeFile(b []byte) (lifetime int64, payload []byte, err error) {
+	if len(b) < 2 || b[0] != headerMagic || b[1] != headerMarker {
+		return 0, b, nil
+	}
+	if len(b) < 3 || b[2] != headerVersion {
+		return 0, nil, errors.New("unknown session file header")
+	}
+	v, n := binary.Uvarint(b[3:])
+	if n <= 0 {
+		return 0, nil, errors.New("session file header is malformed")
+	}
+	return int64(v), b[3+n:], nil
+}
+
+// readLifetime returns the lifetime in the header of the session file, 0 without header
+func readLifetime(file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b := make([]byte, maxHeaderLength)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	lifetime, _, err := decodeFile(b[:n])
+	return lifetime, err
+}
+
+// lifetimeOf returns the lifetime of a session file with lifetime in its header
+func (pdr *ProviderFile) lifetimeOf(lifetime int64) int64 {
+	if lifetime == 0 {
+		return pdr.lifeTime
+	}
+	return lifetime
+}
+
+// expired reports whether a session file of lifetime last refreshed at modTime has expired
+func (pdr *ProviderFile) expired(modTime time.Time, lifetime int64) bool {
+	return modTime.Unix()+pdr.lifetimeOf(lifetime) < time.Now().Unix()
+}
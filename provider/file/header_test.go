@@ -0,0 +1,35 @@
+package file
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileHeader(t *testing.T) {
+	payload := []byte{0x00, 0x03, 'v'}
+	for _, lifetime := range []int64{0, 1, 3600, 1 << 40} {
+		b := encodeFile(lifetime, payload)
+		got, rest, err := decodeFile(b)
+		if err != nil {
+			t.Fatalf("lifetime %d: %v", lifetime, err)
+		}
+		if got != lifetime || !bytes.Equal(rest, payload) {
+			t.Errorf("lifetime %d: decoded %d, %v", lifetime, got, rest)
+		}
+	}
+	if _, _, err := decodeFile([]byte{headerMagic, headerMarker, headerVersion + 1, 1}); err == nil {
+		t.Error("an unknown header version is decoded")
+	}
+	if _, _, err := decodeFile([]byte{headerMagic, headerMarker, headerVersion, 0x80}); err == nil {
+		t.Error("a truncated lifetime is decoded")
+	}
+}
+
+func TestFileWithoutHeader(t *testing.T) {
+	for _, b := range [][]byte{nil, {0x0e, 0xff}, {0x00, 0x02, 0x01}} {
+		lifetime, payload, err := decodeFile(b)
+		if err != nil || lifetime != 0 || !bytes.Equal(payload, b) {
+			t.Errorf("%v: decoded %d, %v, %v", b, lifetime, payload, err)
+		}
+	}
+}
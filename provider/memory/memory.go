@@ -15,20 +15,24 @@
 package memory
 
 import (
-	"container/list"
+	"container/heap"
+	"context"
 	"errors"
+	"github.com/misu99/session"
 	"github.com/misu99/session/store"
 	"sync"
 	"time"
 )
 
-//var memPdr = &ProviderMem{list: list.New(), sessions: make(map[string]*list.Element)}
-
 // SessionStoreMem memory session store.
 // it saved sessions in a map in memory.
 type SessionStoreMem struct {
+	pdr          *ProviderMem
 	sid          string                      //session id
 	timeAccessed time.Time                   //last access time
+	lifetime     int64                       //lifetime of this session, 0 for the provider lifetime
+	expiry       time.Time                   //time the session expires, guarded by the provider lock
+	index        int                         //index in the expiry heap
 	values       map[interface{}]interface{} //session store
 	lock         sync.RWMutex
 }
@@ -55,7 +59,9 @@ func (st *SessionStoreMem) Get(key interface{}) interface{} {
 func (st *SessionStoreMem) Delete(key interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	delete(st.values, key)
+	if !store.IsMetadata(key) {
+		delete(st.values, key)
+	}
 	return nil
 }
 
@@ -63,7 +69,7 @@ func (st *SessionStoreMem) Delete(key interface{}) error {
 func (st *SessionStoreMem) Flush() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	st.values = make(map[interface{}]interface{})
+	st.values = store.KeepMetadata(st.values)
 	return nil
 }
 
@@ -72,19 +78,30 @@ func (st *SessionStoreMem) SessionID() string {
 	return st.sid
 }
 
-// SessionDelay Implement method, no used.
+// Lifetime returns the lifetime of the memory session in seconds
+func (st *SessionStoreMem) Lifetime() int64 {
+	st.pdr.lock.RLock()
+	defer st.pdr.lock.RUnlock()
+	return st.pdr.lifetimeOf(st)
+}
+
+// SessionDelay extend the session as if it were read
 func (st *SessionStoreMem) SessionDelay() {
+	if st.pdr != nil {
+		st.pdr.SessionUpdate(st.sid)
+	}
 }
 
 // SessionRelease Implement method, no used.
-func (st *SessionStoreMem) SessionRelease() {
+func (st *SessionStoreMem) SessionRelease() error {
+	return nil
 }
 
 // ProviderMem Implement the provider interface
 type ProviderMem struct {
-	lock     sync.RWMutex             // locker
-	sessions map[string]*list.Element // map in memory
-	list     *list.List               // for gc
+	lock     sync.RWMutex                // locker
+	sessions map[string]*SessionStoreMem // map in memory
+	expiries expiryHeap                  // for gc, the next session to expire first
 	lifetime int64
 	savePath string
 }
@@ -96,39 +113,45 @@ func (pdr *ProviderMem) SessionInit(lifetime int64, savePath string) error {
 	return nil
 }
 
-// create new memory session by sid
+// SetLifetime set the lifetime of sessions, in seconds
+func (pdr *ProviderMem) SetLifetime(lifetime int64) {
+	pdr.lifetime = lifetime
+}
+
+// create new memory session by sid.
+// lifetime is the lifetime of the session in seconds, 0 for the provider lifetime.
 func (pdr *ProviderMem) SessionNew(sid string, lifetime int64) (store.Store, error) {
-	pdr.lock.RLock()
-	if element, ok := pdr.sessions[sid]; ok {
-		go pdr.SessionUpdate(sid)
-		pdr.lock.RUnlock()
-		return element.Value.(*SessionStoreMem), nil
-	}
-	pdr.lock.RUnlock()
 	pdr.lock.Lock()
-	newSess := &SessionStoreMem{sid: sid, timeAccessed: time.Now(), values: make(map[interface{}]interface{})}
-	element := pdr.list.PushFront(newSess)
-	pdr.sessions[sid] = element
-	pdr.lock.Unlock()
+	defer pdr.lock.Unlock()
+	if st, ok := pdr.sessions[sid]; ok && !pdr.expired(st) {
+		pdr.touch(st)
+		return st, nil
+	} else if ok {
+		pdr.remove(st)
+	}
+	newSess := &SessionStoreMem{pdr: pdr, sid: sid, lifetime: lifetime, values: make(map[interface{}]interface{})}
+	pdr.add(newSess)
 	return newSess, nil
 }
 
 // SessionRead get memory session store by sid
 func (pdr *ProviderMem) SessionRead(sid string) (store.Store, error) {
-	pdr.lock.RLock()
-	if element, ok := pdr.sessions[sid]; ok {
-		go pdr.SessionUpdate(sid)
-		pdr.lock.RUnlock()
-		return element.Value.(*SessionStoreMem), nil
-	}
-	pdr.lock.RUnlock()
-	//pdr.lock.Lock()
-	//newsess := &SessionStoreMem{sid: sid, timeAccessed: time.Now(), values: make(map[interface{}]interface{})}
-	//element := pdr.list.PushFront(newsess)
-	//pdr.sessions[sid] = element
-	//pdr.lock.Unlock()
-	//return newsess, nil
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
+	if st, ok := pdr.sessions[sid]; ok && !pdr.expired(st) {
+		pdr.touch(st)
+		return st, nil
+	}
+	return nil, errors.New("the sid's session not found")
+}
 
+// SessionPeek get memory session store by sid without refreshing it
+func (pdr *ProviderMem) SessionPeek(sid string) (store.Store, error) {
+	pdr.lock.RLock()
+	defer pdr.lock.RUnlock()
+	if st, ok := pdr.sessions[sid]; ok && !pdr.expired(st) {
+		return st, nil
+	}
 	return nil, errors.New("the sid's session not found")
 }
 
@@ -136,35 +159,24 @@ func (pdr *ProviderMem) SessionRead(sid string) (store.Store, error) {
 func (pdr *ProviderMem) SessionExist(sid string) bool {
 	pdr.lock.RLock()
 	defer pdr.lock.RUnlock()
-	if _, ok := pdr.sessions[sid]; ok {
-		return true
-	}
-	return false
+	st, ok := pdr.sessions[sid]
+	return ok && !pdr.expired(st)
 }
 
-// SessionRegenerate generate new sid for session store in memory session
+// SessionRegenerate generate new sid for session store in memory session,
+// the session keeps its lifetime.
 func (pdr *ProviderMem) SessionRegenerate(oldSid, sid string) (store.Store, error) {
-	pdr.lock.RLock()
-	if element, ok := pdr.sessions[oldSid]; ok {
-		go pdr.SessionUpdate(oldSid)
-		pdr.lock.RUnlock()
-		pdr.lock.Lock()
-		element.Value.(*SessionStoreMem).sid = sid
-		pdr.sessions[sid] = element
-
-		if oldSid != sid {
-			delete(pdr.sessions, oldSid)
-		}
-
-		pdr.lock.Unlock()
-		return element.Value.(*SessionStoreMem), nil
-	}
-	pdr.lock.RUnlock()
 	pdr.lock.Lock()
-	newSess := &SessionStoreMem{sid: sid, timeAccessed: time.Now(), values: make(map[interface{}]interface{})}
-	element := pdr.list.PushFront(newSess)
-	pdr.sessions[sid] = element
-	pdr.lock.Unlock()
+	defer pdr.lock.Unlock()
+	if st, ok := pdr.sessions[oldSid]; ok && !pdr.expired(st) {
+		delete(pdr.sessions, oldSid)
+		st.sid = sid
+		pdr.sessions[sid] = st
+		pdr.touch(st)
+		return st, nil
+	}
+	newSess := &SessionStoreMem{pdr: pdr, sid: sid, values: make(map[interface{}]interface{})}
+	pdr.add(newSess)
 	return newSess, nil
 }
 
@@ -172,38 +184,25 @@ func (pdr *ProviderMem) SessionRegenerate(oldSid, sid string) (store.Store, erro
 func (pdr *ProviderMem) SessionDestroy(sid string) error {
 	pdr.lock.Lock()
 	defer pdr.lock.Unlock()
-	if element, ok := pdr.sessions[sid]; ok {
-		delete(pdr.sessions, sid)
-		pdr.list.Remove(element)
-		return nil
+	if st, ok := pdr.sessions[sid]; ok {
+		pdr.remove(st)
 	}
 	return nil
 }
 
 // SessionGC clean expired session stores in memory session
 func (pdr *ProviderMem) SessionGC() {
-	pdr.lock.RLock()
-	for {
-		element := pdr.list.Back()
-		if element == nil {
-			break
-		}
-		if (element.Value.(*SessionStoreMem).timeAccessed.Unix() + pdr.lifetime) < time.Now().Unix() {
-			pdr.lock.RUnlock()
-			pdr.lock.Lock()
-			pdr.list.Remove(element)
-			delete(pdr.sessions, element.Value.(*SessionStoreMem).sid)
-			pdr.lock.Unlock()
-			pdr.lock.RLock()
-		} else {
-			break
-		}
-	}
-	pdr.lock.RUnlock()
+	pdr.lock.Lock()
+	defer pdr.lock.Unlock()
+	for len(pdr.expiries) > 0 && pdr.expired(pdr.expiries[0]) {
+		pdr.remove(pdr.expiries[0])
+	}
 }
 
 // SessionAll id values in mysql session
 func (pdr *ProviderMem) SessionAll() ([]string, error) {
+	pdr.lock.RLock()
+	defer pdr.lock.RUnlock()
 	var keys []string
 	for key := range pdr.sessions {
 		keys = append(keys, key)
@@ -215,16 +214,140 @@ func (pdr *ProviderMem) SessionAll() ([]string, error) {
 func (pdr *ProviderMem) SessionUpdate(sid string) {
 	pdr.lock.Lock()
 	defer pdr.lock.Unlock()
-	if element, ok := pdr.sessions[sid]; ok {
-		element.Value.(*SessionStoreMem).timeAccessed = time.Now()
-		pdr.list.MoveToFront(element)
+	if st, ok := pdr.sessions[sid]; ok {
+		pdr.touch(st)
 	}
 }
 
-//func init() {
-//	session.Register("memory", memPdr)
-//}
+// add a new session, the provider lock must be held
+func (pdr *ProviderMem) add(st *SessionStoreMem) {
+	pdr.sessions[st.sid] = st
+	st.timeAccessed = time.Now()
+	st.expiry = st.timeAccessed.Add(time.Duration(pdr.lifetimeOf(st)) * time.Second)
+	heap.Push(&pdr.expiries, st)
+}
+
+// remove a session, the provider lock must be held
+func (pdr *ProviderMem) remove(st *SessionStoreMem) {
+	delete(pdr.sessions, st.sid)
+	heap.Remove(&pdr.expiries, st.index)
+}
+
+// touch extend a session from now, the provider lock must be held
+func (pdr *ProviderMem) touch(st *SessionStoreMem) {
+	st.timeAccessed = time.Now()
+	st.expiry = st.timeAccessed.Add(time.Duration(pdr.lifetimeOf(st)) * time.Second)
+	heap.Fix(&pdr.expiries, st.index)
+}
+
+func (pdr *ProviderMem) expired(st *SessionStoreMem) bool {
+	return st.expiry.Before(time.Now())
+}
+
+func (pdr *ProviderMem) lifetimeOf(st *SessionStoreMem) int64 {
+	if st.lifetime == 0 {
+		return pdr.lifetime
+	}
+	return st.lifetime
+}
+
+// expiryHeap orders the sessions by expiry, it implements heap.Interface
+type expiryHeap []*SessionStoreMem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	st := x.(*SessionStoreMem)
+	st.index = len(*h)
+	*h = append(*h, st)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	st := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return st
+}
+
+// SessionDelayContext is SessionDelay, it returns early if ctx is done
+func (st *SessionStoreMem) SessionDelayContext(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	st.SessionDelay()
+}
+
+// SessionReleaseContext is SessionRelease, it returns early if ctx is done
+func (st *SessionStoreMem) SessionReleaseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return st.SessionRelease()
+}
+
+// SessionNewContext is SessionNew, it fails early if ctx is done
+func (pdr *ProviderMem) SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionNew(sid, lifetime)
+}
+
+// SessionReadContext is SessionRead, it fails early if ctx is done
+func (pdr *ProviderMem) SessionReadContext(ctx context.Context, sid string) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionRead(sid)
+}
+
+// SessionExistContext is SessionExist, it reports false if ctx is done
+func (pdr *ProviderMem) SessionExistContext(ctx context.Context, sid string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return pdr.SessionExist(sid)
+}
+
+// SessionRegenerateContext is SessionRegenerate, it fails early if ctx is done
+func (pdr *ProviderMem) SessionRegenerateContext(ctx context.Context, oldSid, sid string) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionRegenerate(oldSid, sid)
+}
+
+// SessionDestroyContext is SessionDestroy, it fails early if ctx is done
+func (pdr *ProviderMem) SessionDestroyContext(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pdr.SessionDestroy(sid)
+}
+
+// SessionAllContext is SessionAll, it fails early if ctx is done
+func (pdr *ProviderMem) SessionAllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return pdr.SessionAll()
+}
+
+func init() {
+	session.Register("memory", func() session.Provider {
+		return NewProvider()
+	})
+}
 
+// NewProvider create a new memory session provider
 func NewProvider() *ProviderMem {
-	return &ProviderMem{list: list.New(), sessions: make(map[string]*list.Element)}
+	return &ProviderMem{sessions: make(map[string]*SessionStoreMem)}
 }
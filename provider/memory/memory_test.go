@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLifetime(t *testing.T) {
+	pdr := NewProvider()
+	_ = pdr.SessionInit(3600, "")
+	if _, err := pdr.SessionNew("long", 0); err != nil {
+		t.Fatal(err)
+	}
+	short, err := pdr.SessionNew("short", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := short.(*SessionStoreMem).Lifetime(); l != 1 {
+		t.Errorf("Lifetime = %d, want 1", l)
+	}
+	if short, err = pdr.SessionRegenerate("short", "short2"); err != nil {
+		t.Fatal(err)
+	}
+	if l := short.(*SessionStoreMem).Lifetime(); l != 1 {
+		t.Errorf("Lifetime after regenerate = %d, want 1", l)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := pdr.SessionRead("short2"); err == nil {
+		t.Error("a session past its own lifetime is read")
+	}
+	if _, err := pdr.SessionRead("long"); err != nil {
+		t.Errorf("a session of the provider lifetime is not read: %v", err)
+	}
+	pdr.SessionGC()
+	if all, _ := pdr.SessionAll(); len(all) != 1 || all[0] != "long" {
+		t.Errorf("sessions after gc = %v, want [long]", all)
+	}
+}
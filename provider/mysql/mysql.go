@@ -15,16 +15,24 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"github.com/misu99/session"
+	"github.com/misu99/session/codec"
 	"github.com/misu99/session/store"
 	"github.com/misu99/session/utils"
 	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	mysqldriver "github.com/go-sql-driver/mysql"
 )
 
+// session_expiry is the unix time the session expires,
+// session_lifetime its lifetime in seconds, 0 for the provider lifetime.
+// the column is added to a table created before it as NULL, NULL marks the rows
+// whose session_expiry is still the last access time.
 const (
 	TableName = "session"
 	sqlInit   = `
@@ -32,19 +40,27 @@ const (
 		session_key char(64) NOT NULL,
 		session_data blob,
 		session_expiry int(11) unsigned NOT NULL,
+		session_lifetime int(11) unsigned NOT NULL DEFAULT 0,
 		PRIMARY KEY (session_key)
 		) ENGINE=MyISAM DEFAULT CHARSET=utf8;
 	`
-)
+	sqlAddLifetime = "ALTER TABLE " + TableName + " ADD COLUMN session_lifetime int(11) unsigned NULL"
+	sqlLifetime    = "IFNULL(session_lifetime, 0)"
 
-//var mysqlPdr = &ProviderMySQL{}
+	errDupFieldName = 1060 // ER_DUP_FIELDNAME
+)
 
 // SessionStoreMySQL mysql session store
 type SessionStoreMySQL struct {
-	conn   *sql.DB
-	sid    string
-	lock   sync.RWMutex
-	values map[interface{}]interface{}
+	conn       *sql.DB
+	serializer *codec.Serializer
+	sid        string
+	lock       sync.RWMutex
+	values     map[interface{}]interface{}
+	dirty      bool  // values changed since the last release
+	lifetime   int64 // lifetime of the session in seconds
+
+	skipRefresh bool // releasing an unchanged session does not refresh it
 }
 
 // Set value in mysql session.
@@ -53,6 +69,7 @@ func (st *SessionStoreMySQL) Set(key, value interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	st.values[key] = value
+	st.dirty = true
 	return nil
 }
 
@@ -70,7 +87,10 @@ func (st *SessionStoreMySQL) Get(key interface{}) interface{} {
 func (st *SessionStoreMySQL) Delete(key interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	delete(st.values, key)
+	if _, ok := st.values[key]; ok && !store.IsMetadata(key) {
+		delete(st.values, key)
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -78,7 +98,11 @@ func (st *SessionStoreMySQL) Delete(key interface{}) error {
 func (st *SessionStoreMySQL) Flush() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	st.values = make(map[interface{}]interface{})
+	kept := store.KeepMetadata(st.values)
+	if len(kept) < len(st.values) {
+		st.values = kept
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -87,127 +111,250 @@ func (st *SessionStoreMySQL) SessionID() string {
 	return st.sid
 }
 
-// SessionDelay Implement method, no used.
+// Lifetime returns the lifetime of the mysql session in seconds
+func (st *SessionStoreMySQL) Lifetime() int64 {
+	return st.lifetime
+}
+
+// Dirty reports whether the mysql session is written on release,
+// because a value changed or the stored payload is stale.
+func (st *SessionStoreMySQL) Dirty() bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.dirty
+}
+
+// MarkDirty make the mysql session written on release, Set marks it already,
+// call it after changing a value in place, such as a map got by Get.
+func (st *SessionStoreMySQL) MarkDirty() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.dirty = true
+}
+
+// SessionDelay extend the session by updating session_expiry
 func (st *SessionStoreMySQL) SessionDelay() {
+	st.SessionDelayContext(context.Background())
+}
+
+// SessionDelayContext extend the session by updating session_expiry, the query is bounded by ctx
+func (st *SessionStoreMySQL) SessionDelayContext(ctx context.Context) {
+	_, err := st.conn.ExecContext(ctx, "UPDATE "+TableName+" set `session_expiry`=? where session_key=?",
+		st.expiry(), st.sid)
+	if err != nil {
+		utils.SLogger.Println(err)
+	}
 }
 
 // SessionRelease save mysql session values to database.
 // must call this method to save values to database.
-func (st *SessionStoreMySQL) SessionRelease() {
-	defer func() {
-		err := st.conn.Close()
-		if err != nil {
-			utils.SLogger.Println(err)
+// if no value changed, only session_expiry is updated, unless SetReleaseRefresh turned it off.
+func (st *SessionStoreMySQL) SessionRelease() error {
+	return st.SessionReleaseContext(context.Background())
+}
+
+// SessionReleaseContext save mysql session values to database, the query is bounded by ctx.
+func (st *SessionStoreMySQL) SessionReleaseContext(ctx context.Context) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if !st.dirty {
+		if st.skipRefresh {
+			return nil
 		}
-	}()
+		_, err := st.conn.ExecContext(ctx, "UPDATE "+TableName+" set `session_expiry`=? where session_key=?",
+			st.expiry(), st.sid)
+		return err
+	}
 
-	b, err := utils.EncodeGob(st.values)
+	b, err := st.serializer.Marshal(st.values)
 	if err != nil {
-		utils.SLogger.Println(err)
-		return
+		return err
 	}
-	_, err = st.conn.Exec("UPDATE "+TableName+" set `session_data`=?, `session_expiry`=? where session_key=?",
-		b, time.Now().Unix(), st.sid)
+	_, err = st.conn.ExecContext(ctx, "UPDATE "+TableName+" set `session_data`=?, `session_expiry`=? where session_key=?",
+		b, st.expiry(), st.sid)
 	if err != nil {
-		utils.SLogger.Println(err)
-		return
+		return err
 	}
+	st.dirty = false
+	return nil
 }
 
-// ProviderMySQL mysql session provider
-type ProviderMySQL struct {
-	lifetime int64
-	savePath string
+// expiry returns the unix time the session expires if it is refreshed now
+func (st *SessionStoreMySQL) expiry() int64 {
+	return time.Now().Unix() + st.lifetime
 }
 
-// connect to mysql
-func (pdr *ProviderMySQL) connectInit() *sql.DB {
-	db, e := sql.Open("mysql", pdr.savePath)
-	if e != nil {
-		return nil
-	}
-	return db
+// ProviderMySQL mysql session provider
+type ProviderMySQL struct {
+	lifetime    int64
+	savePath    string
+	db          *sql.DB
+	serializer  codec.Serializer
+	skipRefresh bool // releasing an unchanged session does not refresh it
 }
 
 // SessionInit init mysql session.
+// savePath is the DSN, the connection pool is shared by all sessions of this provider.
 func (pdr *ProviderMySQL) SessionInit(lifetime int64, savePath string) error {
 	pdr.lifetime = lifetime
 	pdr.savePath = savePath
 
-	c := pdr.connectInit()
-	_, err := c.Exec(sqlInit)
-	if err == nil || strings.ContainsAny(err.Error(), "already exists") {
+	db, err := sql.Open("mysql", pdr.savePath)
+	if err != nil {
+		return err
+	}
+	pdr.db = db
+	return pdr.createTable()
+}
+
+// SetCodec set the codec encoding session values, it defaults to codec.Gob.
+// rows written by other codecs can still be read.
+func (pdr *ProviderMySQL) SetCodec(c codec.Codec) {
+	pdr.serializer.Codec = c
+}
+
+// SetCompression compress the session values by c once they are encoded to threshold bytes or more,
+// zero threshold means codec.DefaultCompressThreshold. Rows written compressed or not can be read either way.
+func (pdr *ProviderMySQL) SetCompression(c codec.Compressor, threshold int) {
+	pdr.serializer.Compressor = c
+	pdr.serializer.CompressThreshold = threshold
+}
+
+// SetKeyring encrypt the session rows by the primary key of k,
+// rows sealed by the other keys of k or not encrypted can still be read.
+func (pdr *ProviderMySQL) SetKeyring(k *codec.Keyring) {
+	pdr.serializer.Keyring = k
+}
+
+// SetLifetime set the default lifetime of sessions, in seconds
+func (pdr *ProviderMySQL) SetLifetime(lifetime int64) {
+	pdr.lifetime = lifetime
+}
+
+// SetReleaseRefresh set whether releasing an unchanged session refreshes its lifetime,
+// it does by default. the Manager turns it off when it manages the sliding expiration.
+func (pdr *ProviderMySQL) SetReleaseRefresh(refresh bool) {
+	pdr.skipRefresh = !refresh
+}
+
+// create session table if not exists
+func (pdr *ProviderMySQL) createTable() error {
+	_, err := pdr.db.Exec(sqlInit)
+	if err == nil {
 		return nil
 	}
+	if !strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+	return pdr.migrateTable()
+}
 
+// migrateTable add session_lifetime to a table created before the sessions had their own lifetime,
+// session_expiry of its rows is turned from the last access time to the expiry time by the
+// provider lifetime. each row is converted once, by the same statement setting its
+// session_lifetime, so that instances starting together or a restart after a failure
+// never shift a row twice.
+func (pdr *ProviderMySQL) migrateTable() error {
+	_, err := pdr.db.Exec(sqlAddLifetime)
+	var me *mysqldriver.MySQLError
+	if err != nil && !(errors.As(err, &me) && me.Number == errDupFieldName) {
+		return err
+	}
+	_, err = pdr.db.Exec("UPDATE "+TableName+" set `session_expiry`=`session_expiry`+?, `session_lifetime`=0 where session_lifetime IS NULL",
+		pdr.lifetime)
 	return err
 }
 
+// lifetimeOf returns the lifetime of a session stored with lifetime, 0 is the provider lifetime
+func (pdr *ProviderMySQL) lifetimeOf(lifetime int64) int64 {
+	if lifetime == 0 {
+		return pdr.lifetime
+	}
+	return lifetime
+}
+
 // create new mysql session by sid
 func (pdr *ProviderMySQL) SessionNew(sid string, lifetime int64) (store.Store, error) {
-	c := pdr.connectInit()
-	row := c.QueryRow("select session_data from "+TableName+" where session_key=?", sid)
+	return pdr.SessionNewContext(context.Background(), sid, lifetime)
+}
+
+// SessionNewContext create new mysql session by sid, the queries are bounded by ctx.
+// lifetime is the lifetime of the session in seconds, 0 for the provider lifetime,
+// an existing session keeps its own.
+func (pdr *ProviderMySQL) SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error) {
+	c := pdr.db
+	row := c.QueryRowContext(ctx, "select session_data, "+sqlLifetime+" from "+TableName+" where session_key=? and session_expiry>=?",
+		sid, time.Now().Unix())
 	var data []byte
-	err := row.Scan(&data)
+	err := row.Scan(&data, &lifetime)
 	if err == sql.ErrNoRows {
-		_, err = c.Exec("insert into "+TableName+"(`session_key`,`session_data`,`session_expiry`) values(?,?,?)",
-			sid, "", time.Now().Unix())
-		if err != nil {
-			return nil, err
-		}
+		// replace the expired row the gc has not removed yet
+		_, err = c.ExecContext(ctx, "replace into "+TableName+"(`session_key`,`session_data`,`session_expiry`,`session_lifetime`) values(?,?,?,?)",
+			sid, "", time.Now().Unix()+pdr.lifetimeOf(lifetime), lifetime)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	var kv map[interface{}]interface{}
+	var stale bool
 	if len(data) == 0 {
 		kv = make(map[interface{}]interface{})
 	} else {
-		kv, err = utils.DecodeGob(data)
+		kv, stale, err = pdr.serializer.Unmarshal(data)
 		if err != nil {
 			return nil, err
 		}
 	}
-	rs := &SessionStoreMySQL{conn: c, sid: sid, values: kv}
+	rs := &SessionStoreMySQL{conn: c, serializer: &pdr.serializer, sid: sid, values: kv, dirty: stale,
+		lifetime: pdr.lifetimeOf(lifetime), skipRefresh: pdr.skipRefresh}
 	return rs, nil
 }
 
 // SessionRead get mysql session by sid
 func (pdr *ProviderMySQL) SessionRead(sid string) (store.Store, error) {
-	c := pdr.connectInit()
-	row := c.QueryRow("select session_data from "+TableName+" where session_key=?", sid)
+	return pdr.SessionReadContext(context.Background(), sid)
+}
+
+// SessionReadContext get mysql session by sid, the query is bounded by ctx
+func (pdr *ProviderMySQL) SessionReadContext(ctx context.Context, sid string) (store.Store, error) {
+	c := pdr.db
+	row := c.QueryRowContext(ctx, "select session_data, "+sqlLifetime+" from "+TableName+" where session_key=? and session_expiry>=?",
+		sid, time.Now().Unix())
 	var data []byte
-	err := row.Scan(&data)
-	//if err == sql.ErrNoRows {
-	//	conn.Exec("insert into "+TableName+"(`session_key`,`session_data`,`session_expiry`) values(?,?,?)",
-	//		sid, "", time.Now().Unix())
-	//}
+	var lifetime int64
+	err := row.Scan(&data, &lifetime)
 	if err != nil {
 		return nil, err
 	}
 
 	var kv map[interface{}]interface{}
+	var stale bool
 	if len(data) == 0 {
 		kv = make(map[interface{}]interface{})
 	} else {
-		kv, err = utils.DecodeGob(data)
+		kv, stale, err = pdr.serializer.Unmarshal(data)
 		if err != nil {
 			return nil, err
 		}
 	}
-	rs := &SessionStoreMySQL{conn: c, sid: sid, values: kv}
+	rs := &SessionStoreMySQL{conn: c, serializer: &pdr.serializer, sid: sid, values: kv, dirty: stale,
+		lifetime: pdr.lifetimeOf(lifetime), skipRefresh: pdr.skipRefresh}
 	return rs, nil
 }
 
 // SessionExist check mysql session exist
 func (pdr *ProviderMySQL) SessionExist(sid string) bool {
-	c := pdr.connectInit()
-	defer func() {
-		err := c.Close()
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-	}()
+	return pdr.SessionExistContext(context.Background(), sid)
+}
+
+// SessionExistContext check mysql session exist, the query is bounded by ctx
+func (pdr *ProviderMySQL) SessionExistContext(ctx context.Context, sid string) bool {
+	c := pdr.db
 
-	row := c.QueryRow("select session_data from "+TableName+" where session_key=?", sid)
+	row := c.QueryRowContext(ctx, "select session_data from "+TableName+" where session_key=? and session_expiry>=?",
+		sid, time.Now().Unix())
 	var data []byte
 	err := row.Scan(&data)
 	return err != sql.ErrNoRows
@@ -215,46 +362,57 @@ func (pdr *ProviderMySQL) SessionExist(sid string) bool {
 
 // SessionRegenerate generate new sid for mysql session
 func (pdr *ProviderMySQL) SessionRegenerate(oldSid, sid string) (store.Store, error) {
-	c := pdr.connectInit()
-	row := c.QueryRow("select session_data from "+TableName+" where session_key=?", oldSid)
+	return pdr.SessionRegenerateContext(context.Background(), oldSid, sid)
+}
+
+// SessionRegenerateContext generate new sid for mysql session, the queries are bounded by ctx
+func (pdr *ProviderMySQL) SessionRegenerateContext(ctx context.Context, oldSid, sid string) (store.Store, error) {
+	c := pdr.db
+	row := c.QueryRowContext(ctx, "select session_data, "+sqlLifetime+" from "+TableName+" where session_key=? and session_expiry>=?",
+		oldSid, time.Now().Unix())
 	var data []byte
-	err := row.Scan(&data)
+	var lifetime int64
+	err := row.Scan(&data, &lifetime)
 	if err == sql.ErrNoRows {
-		_, err = c.Exec("insert into "+TableName+"(`session_key`,`session_data`,`session_expiry`) values(?,?,?)", oldSid, "", time.Now().Unix())
+		_, err = c.ExecContext(ctx, "replace into "+TableName+"(`session_key`,`session_data`,`session_expiry`,`session_lifetime`) values(?,?,?,?)",
+			oldSid, "", time.Now().Unix(), 0)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	_, err = c.Exec("update "+TableName+" set `session_key`=?, `session_expiry`=? where session_key=?", sid, time.Now().Unix(), oldSid)
+	// the session keeps its lifetime
+	_, err = c.ExecContext(ctx, "update "+TableName+" set `session_key`=?, `session_expiry`=? where session_key=?",
+		sid, time.Now().Unix()+pdr.lifetimeOf(lifetime), oldSid)
 	if err != nil {
 		return nil, err
 	}
 
 	var kv map[interface{}]interface{}
+	var stale bool
 	if len(data) == 0 {
 		kv = make(map[interface{}]interface{})
 	} else {
-		kv, err = utils.DecodeGob(data)
+		kv, stale, err = pdr.serializer.Unmarshal(data)
 		if err != nil {
 			return nil, err
 		}
 	}
-	rs := &SessionStoreMySQL{conn: c, sid: sid, values: kv}
+	rs := &SessionStoreMySQL{conn: c, serializer: &pdr.serializer, sid: sid, values: kv, dirty: stale,
+		lifetime: pdr.lifetimeOf(lifetime), skipRefresh: pdr.skipRefresh}
 	return rs, nil
 }
 
 // SessionDestroy delete mysql session by sid
 func (pdr *ProviderMySQL) SessionDestroy(sid string) error {
-	c := pdr.connectInit()
-	defer func() {
-		err := c.Close()
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-	}()
+	return pdr.SessionDestroyContext(context.Background(), sid)
+}
 
-	_, err := c.Exec("DELETE FROM "+TableName+" where session_key=?", sid)
+// SessionDestroyContext delete mysql session by sid, the query is bounded by ctx
+func (pdr *ProviderMySQL) SessionDestroyContext(ctx context.Context, sid string) error {
+	c := pdr.db
+
+	_, err := c.ExecContext(ctx, "DELETE FROM "+TableName+" where session_key=?", sid)
 	if err != nil {
 		return err
 	}
@@ -264,15 +422,9 @@ func (pdr *ProviderMySQL) SessionDestroy(sid string) error {
 
 // SessionGC delete expired values in mysql session
 func (pdr *ProviderMySQL) SessionGC() {
-	c := pdr.connectInit()
-	defer func() {
-		err := c.Close()
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-	}()
+	c := pdr.db
 
-	_, err := c.Exec("DELETE from "+TableName+" where session_expiry < ?", time.Now().Unix()-pdr.lifetime)
+	_, err := c.Exec("DELETE from "+TableName+" where session_expiry < ?", time.Now().Unix())
 	if err != nil {
 		utils.SLogger.Println(err)
 	}
@@ -280,15 +432,14 @@ func (pdr *ProviderMySQL) SessionGC() {
 
 // SessionAll id values in mysql session
 func (pdr *ProviderMySQL) SessionAll() ([]string, error) {
-	c := pdr.connectInit()
-	defer func() {
-		err := c.Close()
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-	}()
+	return pdr.SessionAllContext(context.Background())
+}
 
-	rows, err := c.Query("select session_key from " + TableName)
+// SessionAllContext id values in mysql session, the query is bounded by ctx
+func (pdr *ProviderMySQL) SessionAllContext(ctx context.Context) ([]string, error) {
+	c := pdr.db
+
+	rows, err := c.QueryContext(ctx, "select session_key from "+TableName)
 	if err != nil {
 		return nil, err
 	}
@@ -312,10 +463,28 @@ func (pdr *ProviderMySQL) SessionAll() ([]string, error) {
 	return sids, nil
 }
 
-//func init() {
-//	session.Register("mysql", mysqlPdr)
-//}
+func init() {
+	session.Register("mysql", func() session.Provider {
+		return NewProvider()
+	})
+}
 
+// NewProvider create a new mysql session provider
 func NewProvider() *ProviderMySQL {
 	return &ProviderMySQL{}
 }
+
+// NewProviderWithDB create a mysql session provider on an opened database,
+// the session table is created if not exists.
+// lifetime is the default lifetime of the sessions in seconds, the max lifetime of the Manager,
+// an existing table is migrated by it.
+func NewProviderWithDB(db *sql.DB, lifetime int64) (*ProviderMySQL, error) {
+	if lifetime <= 0 {
+		return nil, errors.New("the lifetime of the mysql sessions must be positive")
+	}
+	pdr := &ProviderMySQL{db: db, lifetime: lifetime}
+	if err := pdr.createTable(); err != nil {
+		return nil, err
+	}
+	return pdr, nil
+}
@@ -0,0 +1,66 @@
+package mysql
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// testProvider opens the database of MYSQL_DSN, the test is skipped without it
+func testProvider(t *testing.T) *ProviderMySQL {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdr, err := NewProviderWithDB(db, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pdr
+}
+
+func TestSessionLifetime(t *testing.T) {
+	pdr := testProvider(t)
+	defer pdr.db.Close()
+	defer pdr.SessionDestroy("test-lifetime-long")
+	defer pdr.SessionDestroy("test-lifetime-short")
+
+	if _, err := pdr.SessionNew("test-lifetime-long", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pdr.SessionNew("test-lifetime-short", 1); err != nil {
+		t.Fatal(err)
+	}
+	st, err := pdr.SessionRead("test-lifetime-short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := st.(*SessionStoreMySQL).Lifetime(); l != 1 {
+		t.Errorf("Lifetime from session_lifetime = %d, want 1", l)
+	}
+	if st, err = pdr.SessionRead("test-lifetime-long"); err != nil {
+		t.Fatal(err)
+	}
+	if l := st.(*SessionStoreMySQL).Lifetime(); l != 3600 {
+		t.Errorf("Lifetime of the provider = %d, want 3600", l)
+	}
+
+	// session_expiry is in seconds
+	time.Sleep(2100 * time.Millisecond)
+	if _, err := pdr.SessionRead("test-lifetime-short"); err == nil {
+		t.Error("a session past its own lifetime is read")
+	}
+	pdr.SessionGC()
+	var n int
+	if err := pdr.db.QueryRow("select count(*) from "+TableName+" where session_key=?", "test-lifetime-short").Scan(&n); err != nil || n != 0 {
+		t.Errorf("gc kept the expired session: %d rows, %v", n, err)
+	}
+	if !pdr.SessionExist("test-lifetime-long") {
+		t.Error("gc removed a session of the provider lifetime")
+	}
+}
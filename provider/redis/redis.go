@@ -15,8 +15,12 @@
 package redis
 
 import (
+	"context"
+	"github.com/misu99/session"
+	"github.com/misu99/session/codec"
 	"github.com/misu99/session/store"
 	"github.com/misu99/session/utils"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,17 +30,25 @@ import (
 )
 
 const MaxPoolSize = 100
-const LifeTimeKey = "lifetime"
 
-//var redisPdr = &ProviderRedis{}
+// LifeTimeKey holds the lifetime of a session in its values, it is session metadata
+// so that Flush and Delete keep it.
+const LifeTimeKey = store.MetadataPrefix + "lifetime"
+
+// legacyLifeTimeKey is the LifeTimeKey of the sessions written before it was metadata
+const legacyLifeTimeKey = "lifetime"
 
 // SessionStoreRedis redis session store
 type SessionStoreRedis struct {
-	pl       *redis.Pool
-	sid      string
-	lock     sync.RWMutex
-	values   map[interface{}]interface{}
-	lifetime int64
+	pl         *redis.Pool
+	serializer *codec.Serializer
+	sid        string
+	lock       sync.RWMutex
+	values     map[interface{}]interface{}
+	dirty      bool // values changed since the last release
+	lifetime   int64
+
+	skipRefresh bool // releasing an unchanged session does not refresh it
 }
 
 // Set value in redis session
@@ -44,6 +56,7 @@ func (st *SessionStoreRedis) Set(key, value interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	st.values[key] = value
+	st.dirty = true
 	return nil
 }
 
@@ -61,7 +74,10 @@ func (st *SessionStoreRedis) Get(key interface{}) interface{} {
 func (st *SessionStoreRedis) Delete(key interface{}) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	delete(st.values, key)
+	if _, ok := st.values[key]; ok && !store.IsMetadata(key) {
+		delete(st.values, key)
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -69,7 +85,11 @@ func (st *SessionStoreRedis) Delete(key interface{}) error {
 func (st *SessionStoreRedis) Flush() error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
-	st.values = make(map[interface{}]interface{})
+	kept := store.KeepMetadata(st.values)
+	if len(kept) < len(st.values) {
+		st.values = kept
+		st.dirty = true
+	}
 	return nil
 }
 
@@ -78,9 +98,39 @@ func (st *SessionStoreRedis) SessionID() string {
 	return st.sid
 }
 
+// Lifetime returns the lifetime of the redis session in seconds
+func (st *SessionStoreRedis) Lifetime() int64 {
+	return st.lifetime
+}
+
+// Dirty reports whether the redis session is written on release,
+// because a value changed or the stored payload is stale.
+func (st *SessionStoreRedis) Dirty() bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.dirty
+}
+
+// MarkDirty make the redis session written on release, Set marks it already,
+// call it after changing a value in place, such as a map got by Get.
+func (st *SessionStoreRedis) MarkDirty() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.dirty = true
+}
+
 // SessionDelay session延期
 func (st *SessionStoreRedis) SessionDelay() {
-	c := st.pl.Get()
+	st.SessionDelayContext(context.Background())
+}
+
+// SessionDelayContext session延期, the redis call is bounded by ctx
+func (st *SessionStoreRedis) SessionDelayContext(ctx context.Context) {
+	c, err := st.pl.GetContext(ctx)
+	if err != nil {
+		utils.SLogger.Println(err)
+		return
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -88,19 +138,38 @@ func (st *SessionStoreRedis) SessionDelay() {
 		}
 	}()
 
-	_, err := c.Do("EXPIRE", st.sid, st.lifetime)
+	_, err = do(ctx, c, "EXPIRE", st.sid, st.lifetime)
 	if err != nil {
 		utils.SLogger.Println(err)
 	}
 }
 
-// SessionRelease save session values to redis
-func (st *SessionStoreRedis) SessionRelease() {
-	b, err := utils.EncodeGob(st.values)
+// SessionRelease save session values to redis.
+// if no value changed, only the TTL is refreshed, unless SetReleaseRefresh turned it off.
+func (st *SessionStoreRedis) SessionRelease() error {
+	return st.SessionReleaseContext(context.Background())
+}
+
+// SessionReleaseContext save session values to redis, the redis call is bounded by ctx
+func (st *SessionStoreRedis) SessionReleaseContext(ctx context.Context) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if !st.dirty && st.skipRefresh {
+		return nil
+	}
+	var b []byte
+	var err error
+	if st.dirty {
+		b, err = st.serializer.Marshal(st.values)
+		if err != nil {
+			return err
+		}
+	}
+	c, err := st.pl.GetContext(ctx)
 	if err != nil {
-		return
+		return err
 	}
-	c := st.pl.Get()
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -108,20 +177,30 @@ func (st *SessionStoreRedis) SessionRelease() {
 		}
 	}()
 
-	_, err = c.Do("SETEX", st.sid, st.lifetime, string(b))
+	if !st.dirty {
+		_, err = do(ctx, c, "EXPIRE", st.sid, st.lifetime)
+		return err
+	}
+
+	_, err = do(ctx, c, "SETEX", st.sid, st.lifetime, string(b))
 	if err != nil {
-		utils.SLogger.Println(err)
+		return err
 	}
+	st.dirty = false
+	return nil
 }
 
 // ProviderRedis redis session provider
 type ProviderRedis struct {
-	lifetime int64 // 全局默认生命周期
-	savePath string
-	poolSize int
-	password string
-	dbIndex  int
-	pl       *redis.Pool
+	lifetime   int64 // 全局默认生命周期
+	savePath   string
+	poolSize   int
+	password   string
+	dbIndex    int
+	pl         *redis.Pool
+	serializer codec.Serializer
+
+	skipRefresh bool // releasing an unchanged session does not refresh it
 }
 
 // SessionInit init redis session
@@ -193,13 +272,51 @@ func (pdr *ProviderRedis) SessionInit(lifetime int64, savePath string) error {
 	return pdr.pl.Get().Err()
 }
 
+// SetCodec set the codec encoding session values, it defaults to codec.Gob.
+// keys written by other codecs can still be read.
+func (pdr *ProviderRedis) SetCodec(c codec.Codec) {
+	pdr.serializer.Codec = c
+}
+
+// SetCompression compress the session values by c once they are encoded to threshold bytes or more,
+// zero threshold means codec.DefaultCompressThreshold. Keys written compressed or not can be read either way.
+func (pdr *ProviderRedis) SetCompression(c codec.Compressor, threshold int) {
+	pdr.serializer.Compressor = c
+	pdr.serializer.CompressThreshold = threshold
+}
+
+// SetKeyring encrypt the session values by the primary key of k,
+// keys sealed by the other keys of k or not encrypted can still be read.
+func (pdr *ProviderRedis) SetKeyring(k *codec.Keyring) {
+	pdr.serializer.Keyring = k
+}
+
+// SetLifetime set the default lifetime of sessions, in seconds
+func (pdr *ProviderRedis) SetLifetime(lifetime int64) {
+	pdr.lifetime = lifetime
+}
+
+// SetReleaseRefresh set whether releasing an unchanged session refreshes its lifetime,
+// it does by default. the Manager turns it off when it manages the sliding expiration.
+func (pdr *ProviderRedis) SetReleaseRefresh(refresh bool) {
+	pdr.skipRefresh = !refresh
+}
+
 // create new redis session by sid
 func (pdr *ProviderRedis) SessionNew(sid string, lifetime int64) (store.Store, error) {
+	return pdr.SessionNewContext(context.Background(), sid, lifetime)
+}
+
+// SessionNewContext create new redis session by sid, the redis calls are bounded by ctx
+func (pdr *ProviderRedis) SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error) {
 	if lifetime == 0 {
 		lifetime = pdr.lifetime // 未指定生命周期使用全局默认
 	}
 
-	c := pdr.pl.Get()
+	c, err := pdr.pl.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -208,27 +325,37 @@ func (pdr *ProviderRedis) SessionNew(sid string, lifetime int64) (store.Store, e
 	}()
 
 	var kv map[interface{}]interface{}
+	var dirty bool
 
-	kvs, err := redis.String(c.Do("GET", sid))
+	kvs, err := redis.String(do(ctx, c, "GET", sid))
 	if err != nil && err != redis.ErrNil {
 		return nil, err
 	}
 	if len(kvs) == 0 {
 		kv = make(map[interface{}]interface{})
 		kv[LifeTimeKey] = lifetime
+		dirty = true // not in redis yet, must be written on release
 	} else {
-		if kv, err = utils.DecodeGob([]byte(kvs)); err != nil {
+		if kv, dirty, err = pdr.serializer.Unmarshal([]byte(kvs)); err != nil {
 			return nil, err
 		}
 	}
 
-	st := &SessionStoreRedis{pl: pdr.pl, sid: sid, values: kv, lifetime: lifetime}
+	st := &SessionStoreRedis{pl: pdr.pl, serializer: &pdr.serializer, sid: sid, values: kv, dirty: dirty, lifetime: lifetime, skipRefresh: pdr.skipRefresh}
 	return st, nil
 }
 
 // read redis session by sid
 func (pdr *ProviderRedis) SessionRead(sid string) (store.Store, error) {
-	c := pdr.pl.Get()
+	return pdr.SessionReadContext(context.Background(), sid)
+}
+
+// SessionReadContext read redis session by sid, the redis calls are bounded by ctx
+func (pdr *ProviderRedis) SessionReadContext(ctx context.Context, sid string) (store.Store, error) {
+	c, err := pdr.pl.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -237,8 +364,9 @@ func (pdr *ProviderRedis) SessionRead(sid string) (store.Store, error) {
 	}()
 
 	var kv map[interface{}]interface{}
+	var stale bool
 
-	kvs, err := redis.String(c.Do("GET", sid))
+	kvs, err := redis.String(do(ctx, c, "GET", sid))
 	//if err != nil && err != redis.ErrNil {
 	if err != nil {
 		return nil, err
@@ -246,26 +374,55 @@ func (pdr *ProviderRedis) SessionRead(sid string) (store.Store, error) {
 	if len(kvs) == 0 {
 		kv = make(map[interface{}]interface{})
 	} else {
-		if kv, err = utils.DecodeGob([]byte(kvs)); err != nil {
+		if kv, stale, err = pdr.serializer.Unmarshal([]byte(kvs)); err != nil {
 			return nil, err
 		}
 	}
 
 	// 读取最大生命周期
-	var lifetime int64
-	if v, ok := kv[LifeTimeKey]; ok {
-		lifetime = v.(int64)
-	} else {
-		lifetime = pdr.lifetime // 未指定生命周期使用全局默认
+	lifetime, ok := lifetimeValue(kv[LifeTimeKey])
+	if !ok {
+		if lifetime, ok = lifetimeValue(kv[legacyLifeTimeKey]); ok {
+			// moved to LifeTimeKey once
+			delete(kv, legacyLifeTimeKey)
+			kv[LifeTimeKey] = lifetime
+			stale = true
+		} else {
+			lifetime = pdr.lifetime // 未指定生命周期使用全局默认
+		}
 	}
 
-	st := &SessionStoreRedis{pl: pdr.pl, sid: sid, values: kv, lifetime: lifetime}
+	st := &SessionStoreRedis{pl: pdr.pl, serializer: &pdr.serializer, sid: sid, values: kv, dirty: stale, lifetime: lifetime, skipRefresh: pdr.skipRefresh}
 	return st, nil
 }
 
+// lifetimeValue returns the lifetime stored in the values, whichever number type the codec decoded it to
+func lifetimeValue(v interface{}) (int64, bool) {
+	var n int64
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = int64(rv.Uint())
+	case reflect.Float32, reflect.Float64: // json codec
+		n = int64(rv.Float())
+	default:
+		return 0, false
+	}
+	return n, n > 0
+}
+
 // SessionExist check redis session exist by sid
 func (pdr *ProviderRedis) SessionExist(sid string) bool {
-	c := pdr.pl.Get()
+	return pdr.SessionExistContext(context.Background(), sid)
+}
+
+// SessionExistContext check redis session exist by sid, the redis calls are bounded by ctx
+func (pdr *ProviderRedis) SessionExistContext(ctx context.Context, sid string) bool {
+	c, err := pdr.pl.GetContext(ctx)
+	if err != nil {
+		return false
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -273,7 +430,7 @@ func (pdr *ProviderRedis) SessionExist(sid string) bool {
 		}
 	}()
 
-	if existed, err := redis.Int(c.Do("EXISTS", sid)); err != nil || existed == 0 {
+	if existed, err := redis.Int(do(ctx, c, "EXISTS", sid)); err != nil || existed == 0 {
 		return false
 	}
 	return true
@@ -281,7 +438,15 @@ func (pdr *ProviderRedis) SessionExist(sid string) bool {
 
 // SessionRegenerate generate new sid for redis session
 func (pdr *ProviderRedis) SessionRegenerate(oldSid, sid string) (store.Store, error) {
-	c := pdr.pl.Get()
+	return pdr.SessionRegenerateContext(context.Background(), oldSid, sid)
+}
+
+// SessionRegenerateContext generate new sid for redis session, the redis calls are bounded by ctx
+func (pdr *ProviderRedis) SessionRegenerateContext(ctx context.Context, oldSid, sid string) (store.Store, error) {
+	c, err := pdr.pl.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -289,30 +454,44 @@ func (pdr *ProviderRedis) SessionRegenerate(oldSid, sid string) (store.Store, er
 		}
 	}()
 
-	if existed, _ := redis.Int(c.Do("EXISTS", oldSid)); existed == 0 {
+	if existed, _ := redis.Int(do(ctx, c, "EXISTS", oldSid)); existed == 0 {
 		// oldSid doesn't exists, set the new sid directly
 		// ignore error here, since if it return error
 		// the existed value will be 0
-		_, err := c.Do("SET", sid, "", "EX", pdr.lifetime)
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-	} else {
-		_, err := c.Do("RENAME", oldSid, sid)
-		if err != nil {
-			utils.SLogger.Println(err)
-		}
-		_, err = c.Do("EXPIRE", sid, pdr.lifetime)
+		_, err := do(ctx, c, "SET", sid, "", "EX", pdr.lifetime)
 		if err != nil {
 			utils.SLogger.Println(err)
 		}
+		return pdr.SessionReadContext(ctx, sid)
 	}
-	return pdr.SessionRead(sid)
+
+	_, err = do(ctx, c, "RENAME", oldSid, sid)
+	if err != nil {
+		utils.SLogger.Println(err)
+	}
+	st, err := pdr.SessionReadContext(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	// refreshed by the lifetime of the session itself
+	_, err = do(ctx, c, "EXPIRE", sid, st.(*SessionStoreRedis).lifetime)
+	if err != nil {
+		utils.SLogger.Println(err)
+	}
+	return st, nil
 }
 
 // SessionDestroy delete redis session by id
 func (pdr *ProviderRedis) SessionDestroy(sid string) error {
-	c := pdr.pl.Get()
+	return pdr.SessionDestroyContext(context.Background(), sid)
+}
+
+// SessionDestroyContext delete redis session by id, the redis call is bounded by ctx
+func (pdr *ProviderRedis) SessionDestroyContext(ctx context.Context, sid string) error {
+	c, err := pdr.pl.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -320,7 +499,7 @@ func (pdr *ProviderRedis) SessionDestroy(sid string) error {
 		}
 	}()
 
-	_, err := c.Do("DEL", sid)
+	_, err = do(ctx, c, "DEL", sid)
 	return err
 }
 
@@ -328,9 +507,17 @@ func (pdr *ProviderRedis) SessionDestroy(sid string) error {
 func (pdr *ProviderRedis) SessionGC() {
 }
 
-// SessionAll id values in mysql session
+// SessionAll id values in redis session
 func (pdr *ProviderRedis) SessionAll() ([]string, error) {
-	c := pdr.pl.Get()
+	return pdr.SessionAllContext(context.Background())
+}
+
+// SessionAllContext id values in redis session, the redis call is bounded by ctx
+func (pdr *ProviderRedis) SessionAllContext(ctx context.Context) ([]string, error) {
+	c, err := pdr.pl.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		err := c.Close()
 		if err != nil {
@@ -338,7 +525,7 @@ func (pdr *ProviderRedis) SessionAll() ([]string, error) {
 		}
 	}()
 
-	values, err := redis.Strings(c.Do("KEYS", "*"))
+	values, err := redis.Strings(do(ctx, c, "KEYS", "*"))
 	if err != nil {
 		return nil, err
 	}
@@ -346,10 +533,30 @@ func (pdr *ProviderRedis) SessionAll() ([]string, error) {
 	return values, nil
 }
 
-//func init() {
-//	session.Register("redis", redisPdr)
-//}
+func init() {
+	session.Register("redis", func() session.Provider {
+		return NewProvider()
+	})
+}
 
+// NewProvider create a new redis session provider
 func NewProvider() *ProviderRedis {
 	return &ProviderRedis{}
 }
+
+// NewProviderWithPool create a redis session provider on a configured pool.
+// use it with session.New, the lifetime is set by the Manager.
+func NewProviderWithPool(pl *redis.Pool) *ProviderRedis {
+	return &ProviderRedis{pl: pl}
+}
+
+// do send a command on c, bounded by the deadline of ctx if it has one.
+func do(ctx context.Context, c redis.Conn, commandName string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(c, time.Until(deadline), commandName, args...)
+	}
+	return c.Do(commandName, args...)
+}
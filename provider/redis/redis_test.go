@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/misu99/session/codec"
+)
+
+// fakeRedis is an in-memory redis answering the commands of the provider
+type fakeRedis struct {
+	lock    sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: make(map[string]string), expires: make(map[string]time.Time)}
+}
+
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return time.Until(f.expires[key])
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	if e, ok := f.expires[key]; ok && time.Now().After(e) {
+		delete(f.values, key)
+		delete(f.expires, key)
+	}
+	_, ok := f.values[key]
+	return ok
+}
+
+func (f *fakeRedis) setTTL(key string, arg interface{}) {
+	seconds, _ := strconv.Atoi(redisArg(arg))
+	f.expires[key] = time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+func redisArg(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	}
+	return ""
+}
+
+func (f *fakeRedis) do(cmd string, args ...interface{}) (interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := ""
+	if len(args) > 0 {
+		key = redisArg(args[0])
+	}
+	switch cmd {
+	case "GET":
+		if !f.exists(key) {
+			return nil, nil
+		}
+		return []byte(f.values[key]), nil
+	case "SET": // key value EX seconds
+		f.values[key] = redisArg(args[1])
+		f.setTTL(key, args[3])
+		return "OK", nil
+	case "SETEX":
+		f.values[key] = redisArg(args[2])
+		f.setTTL(key, args[1])
+		return "OK", nil
+	case "EXPIRE":
+		if !f.exists(key) {
+			return int64(0), nil
+		}
+		f.setTTL(key, args[1])
+		return int64(1), nil
+	case "EXISTS":
+		if f.exists(key) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "DEL":
+		delete(f.values, key)
+		delete(f.expires, key)
+		return int64(1), nil
+	case "RENAME":
+		if !f.exists(key) {
+			return nil, redis.Error("ERR no such key")
+		}
+		to := redisArg(args[1])
+		f.values[to], f.expires[to] = f.values[key], f.expires[key]
+		delete(f.values, key)
+		delete(f.expires, key)
+		return "OK", nil
+	case "KEYS":
+		var keys []interface{}
+		for k := range f.values {
+			if f.exists(k) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return keys, nil
+	}
+	return nil, errors.New("fake redis: unknown command " + cmd)
+}
+
+type fakeConn struct {
+	f *fakeRedis
+}
+
+func (c fakeConn) Close() error { return nil }
+func (c fakeConn) Err() error   { return nil }
+func (c fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.f.do(cmd, args...)
+}
+func (c fakeConn) Send(cmd string, args ...interface{}) error {
+	return errors.New("fake redis: no pipelining")
+}
+func (c fakeConn) Flush() error                  { return nil }
+func (c fakeConn) Receive() (interface{}, error) { return nil, errors.New("fake redis: no pipelining") }
+
+func testProvider(f *fakeRedis) *ProviderRedis {
+	pdr := NewProviderWithPool(&redis.Pool{Dial: func() (redis.Conn, error) { return fakeConn{f}, nil }})
+	pdr.SetLifetime(3600)
+	return pdr
+}
+
+func TestSessionLifetimeSurvivesFlush(t *testing.T) {
+	f := newFakeRedis()
+	pdr := testProvider(f)
+	st, err := pdr.SessionNew("sid-lifetime", 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set("user", "alice")
+	if err := st.SessionRelease(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = pdr.SessionRead("sid-lifetime"); err != nil {
+		t.Fatal(err)
+	}
+	st.Flush()
+	st.Delete(LifeTimeKey)
+	if err := st.SessionRelease(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = pdr.SessionRead("sid-lifetime"); err != nil {
+		t.Fatal(err)
+	}
+	if l := st.(*SessionStoreRedis).Lifetime(); l != 120 {
+		t.Errorf("Lifetime after Flush = %d, want 120", l)
+	}
+	if st.Get("user") != nil {
+		t.Error("Flush kept a user value")
+	}
+	if ttl := f.ttl("sid-lifetime"); ttl > 120*time.Second || ttl < 110*time.Second {
+		t.Errorf("ttl after Flush = %v, want 120s", ttl)
+	}
+}
+
+func TestLegacyLifetimeKey(t *testing.T) {
+	f := newFakeRedis()
+	pdr := testProvider(f)
+	b, err := (&codec.Serializer{}).Marshal(map[interface{}]interface{}{legacyLifeTimeKey: int64(60), "user": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.do("SETEX", "sid-legacy", 60, string(b))
+
+	st, err := pdr.SessionRead("sid-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := st.(*SessionStoreRedis)
+	if rs.Lifetime() != 60 || !rs.Dirty() {
+		t.Errorf("legacy lifetime: Lifetime %d, Dirty %v, want 60, true", rs.Lifetime(), rs.Dirty())
+	}
+	if st.Get(legacyLifeTimeKey) != nil || st.Get(LifeTimeKey) != int64(60) {
+		t.Errorf("legacy key %v, LifeTimeKey %v", st.Get(legacyLifeTimeKey), st.Get(LifeTimeKey))
+	}
+}
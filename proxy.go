@@ -0,0 +1,194 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwarded headers honoured from the trusted proxies
+const (
+	ProxyHeaderXForwarded = "X-Forwarded" // X-Forwarded-Proto and X-Forwarded-For, the default
+	ProxyHeaderForwarded  = "Forwarded"   // Forwarded: for=...;proto=..., see RFC 7239
+)
+
+// parseTrustedProxies parse the CIDRs or single IPs of the trusted proxies
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("session: trusted proxy %s is not an IP or CIDR", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("session: trusted proxy %s is not an IP or CIDR", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (manager *Manager) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range manager.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP of the immediate peer of r, nil if RemoteAddr is not an IP
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedProto returns the scheme the client used as told by the nearest proxy,
+// empty if the immediate peer is not a trusted proxy.
+func (manager *Manager) forwardedProto(r *http.Request) string {
+	if !manager.isTrustedProxy(peerIP(r)) {
+		return ""
+	}
+	if manager.config.ProxyHeader == ProxyHeaderForwarded {
+		elements := forwardedElements(r.Header)
+		if len(elements) == 0 {
+			return ""
+		}
+		return strings.ToLower(elements[len(elements)-1]["proto"])
+	}
+	values := headerList(r.Header, "X-Forwarded-Proto")
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.ToLower(values[len(values)-1])
+}
+
+// ClientIP returns the IP of the client of r, for session metadata such as binding
+// a session to its client or auditing. the Manager records it under ClientIPKey in every
+// session it creates for a request.
+// the forwarded addresses are followed from the nearest one as long as they are
+// trusted proxies, so that a client can not forge its address through the header.
+// without trusted proxies it is the immediate peer.
+func (manager *Manager) ClientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !manager.isTrustedProxy(ip) {
+		return ipString(ip, r.RemoteAddr)
+	}
+
+	var hops []string
+	if manager.config.ProxyHeader == ProxyHeaderForwarded {
+		for _, element := range forwardedElements(r.Header) {
+			hops = append(hops, element["for"])
+		}
+	} else {
+		hops = headerList(r.Header, "X-Forwarded-For")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(stripPort(hops[i]))
+		if hop == nil {
+			// unknown or obfuscated, the proxy does not tell who is behind it
+			break
+		}
+		ip = hop
+		if !manager.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func ipString(ip net.IP, remoteAddr string) string {
+	if ip == nil {
+		return remoteAddr
+	}
+	return ip.String()
+}
+
+// headerList returns the comma separated values of every header name
+func headerList(h http.Header, name string) []string {
+	var values []string
+	for _, line := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// forwardedElements parse the Forwarded headers into one map of lower case
+// parameter names to unquoted values per element, the nearest proxy last.
+func forwardedElements(h http.Header) []map[string]string {
+	var elements []map[string]string
+	for _, line := range h["Forwarded"] {
+		for _, element := range splitQuoted(line, ',') {
+			params := make(map[string]string)
+			for _, pair := range splitQuoted(element, ';') {
+				i := strings.IndexByte(pair, '=')
+				if i <= 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				value := strings.TrimSpace(pair[i+1:])
+				if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+					value = strings.Replace(value[1:len(value)-1], `\`, "", -1)
+				}
+				params[key] = value
+			}
+			elements = append(elements, params)
+		}
+	}
+	return elements
+}
+
+// splitQuoted split s by sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stripPort returns the address of a forwarded node without its port,
+// such as 192.0.2.1:8080 or [2001:db8::1]:8080.
+func stripPort(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.IndexByte(node, ']'); i > 0 {
+			return node[1:i]
+		}
+		return node
+	}
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.IndexByte(node, ':')]
+	}
+	return node
+}
@@ -0,0 +1,104 @@
+package session_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/memory"
+)
+
+func proxyManager(t *testing.T, opts ...session.Option) *session.Manager {
+	opts = append([]session.Option{session.WithGCLifetime(time.Hour)}, opts...)
+	manager, err := session.New(memory.NewProvider(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestClientIP(t *testing.T) {
+	xff := proxyManager(t, session.WithTrustedProxies("", "10.0.0.0/8"))
+	forwarded := proxyManager(t, session.WithTrustedProxies(session.ProxyHeaderForwarded, "10.0.0.1", "2001:db8::/32"))
+	untrusted := proxyManager(t)
+
+	tests := []struct {
+		name    string
+		manager *session.Manager
+		peer    string
+		header  string
+		value   string
+		want    string
+	}{
+		{"no proxy", untrusted, "192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1", "192.0.2.1"},
+		{"untrusted peer", xff, "192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1", "192.0.2.1"},
+		{"trusted peer", xff, "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		{"proxy chain", xff, "10.0.0.1:1234", "X-Forwarded-For", "203.0.113.9, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"all trusted", xff, "10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"obfuscated", xff, "10.0.0.1:1234", "X-Forwarded-For", "_hidden, 10.0.0.2", "10.0.0.2"},
+		{"no header", xff, "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"forwarded", forwarded, "10.0.0.1:1234", "Forwarded", `for=198.51.100.1;proto=https`, "198.51.100.1"},
+		{"forwarded ipv6", forwarded, "10.0.0.1:1234", "Forwarded", `for="[2001:db8::2]:443", For="[2001:db9::1]:8080"`, "2001:db9::1"},
+		{"forwarded quoted", forwarded, "10.0.0.1:1234", "Forwarded", `for="198.51.100.1";by="a,b", for=unknown`, "10.0.0.1"},
+		{"forwarded ignores xff", forwarded, "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := tt.manager.ClientIP(r); got != tt.want {
+			t.Errorf("%s: ClientIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForwardedProtoSecure(t *testing.T) {
+	manager := proxyManager(t, session.WithSecure(true), session.WithTrustedProxies("", "10.0.0.0/8"))
+	for _, tt := range []struct {
+		peer   string
+		secure bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"192.0.2.1:1234", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		if _, err := manager.SessionStart(w, r); err != nil {
+			t.Fatal(err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Secure != tt.secure {
+			t.Errorf("peer %s: cookies %v, want Secure %v", tt.peer, cookies, tt.secure)
+		}
+	}
+}
+
+func TestClientIPRecorded(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []session.Option
+	}{
+		{"timeouts", []session.Option{session.WithTimeouts(time.Hour, 0)}},
+		{"no timeouts", nil},
+		{"lazy", []session.Option{session.WithLazySession(true)}},
+	}
+	for _, tt := range tests {
+		manager := proxyManager(t, append(tt.opts, session.WithTrustedProxies("", "10.0.0.0/8"))...)
+		var ip interface{}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		manager.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = session.FromContext(r.Context()).Get(session.ClientIPKey)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if ip != "198.51.100.1" {
+			t.Errorf("%s: ClientIPKey = %v, want 198.51.100.1", tt.name, ip)
+		}
+	}
+}
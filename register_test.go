@@ -0,0 +1,67 @@
+package session_test
+
+import (
+	"testing"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/memory"
+)
+
+// registered are the providers made by the factory of "registry-test"
+var registered []*memory.ProviderMem
+
+func init() {
+	session.Register("registry-test", func() session.Provider {
+		pdr := memory.NewProvider()
+		registered = append(registered, pdr)
+		return pdr
+	})
+}
+
+func TestRegisterPanics(t *testing.T) {
+	tests := []struct {
+		name    string
+		factory session.ProviderFactory
+	}{
+		{"memory", func() session.Provider { return memory.NewProvider() }}, // registered twice
+		{"registry-nil", nil},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) did not panic", tt.name)
+				}
+			}()
+			session.Register(tt.name, tt.factory)
+		}()
+	}
+}
+
+func TestGetProvider(t *testing.T) {
+	if pdr, err := session.GetProvider("no-such-provider"); err == nil || pdr != nil {
+		t.Errorf("GetProvider of an unknown name = %v, %v", pdr, err)
+	}
+	if _, err := session.NewManager("no-such-provider", &session.ManagerConfig{CookieName: "sid", Gclifetime: 3600}); err == nil {
+		t.Error("NewManager of an unknown provider succeeded")
+	}
+
+	registered = nil
+	first, err := session.NewManager("registry-test", &session.ManagerConfig{CookieName: "sid", Gclifetime: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.NewManager("registry-test", &session.ManagerConfig{CookieName: "sid", Gclifetime: 3600}); err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) != 2 {
+		t.Fatalf("the factory made %d providers for 2 managers", len(registered))
+	}
+	st, err := first.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !registered[0].SessionExist(st.SessionID()) || registered[1].SessionExist(st.SessionID()) {
+		t.Error("the manager does not use the provider its factory made")
+	}
+}
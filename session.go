@@ -15,24 +15,22 @@
 package session
 
 import (
-	"crypto/rand"
-	"encoding/hex"
-	"errors"
+	"context"
 	"fmt"
-	"github.com/misu99/session/provider/file"
-	"github.com/misu99/session/provider/memory"
-	"github.com/misu99/session/provider/mysql"
-	"github.com/misu99/session/provider/redis"
+	"github.com/misu99/session/codec"
 	"github.com/misu99/session/store"
+	"github.com/misu99/session/utils"
+	"net"
 	"net/http"
-	"net/textproto"
-	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-//var (
-// provides = make(map[string]Provider)
-//)
+var (
+	providesLock sync.RWMutex
+	provides     = make(map[string]ProviderFactory)
+)
 
 // Provider contains global session methods and saved SessionStores.
 // it can operate a SessionStore by its id.
@@ -47,66 +45,200 @@ type Provider interface {
 	SessionGC()
 }
 
+// ContextProvider is a Provider whose backend calls can be cancelled by a context.
+// all built-in providers implement it, other providers are adapted by the Manager
+// and only get ctx checked before each call.
+type ContextProvider interface {
+	Provider
+	SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error)
+	SessionReadContext(ctx context.Context, sid string) (store.Store, error)
+	SessionExistContext(ctx context.Context, sid string) bool
+	SessionRegenerateContext(ctx context.Context, oldsid, sid string) (store.Store, error)
+	SessionDestroyContext(ctx context.Context, sid string) error
+	SessionAllContext(ctx context.Context) ([]string, error)
+}
+
+// contextProvider adapts a Provider without context support to ContextProvider.
+type contextProvider struct {
+	Provider
+}
+
+func withContext(provider Provider) ContextProvider {
+	if cp, ok := provider.(ContextProvider); ok {
+		return cp
+	}
+	return contextProvider{provider}
+}
+
+func (cp contextProvider) SessionNewContext(ctx context.Context, sid string, lifetime int64) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cp.SessionNew(sid, lifetime)
+}
+
+func (cp contextProvider) SessionReadContext(ctx context.Context, sid string) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cp.SessionRead(sid)
+}
+
+func (cp contextProvider) SessionExistContext(ctx context.Context, sid string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return cp.SessionExist(sid)
+}
+
+func (cp contextProvider) SessionRegenerateContext(ctx context.Context, oldsid, sid string) (store.Store, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cp.SessionRegenerate(oldsid, sid)
+}
+
+func (cp contextProvider) SessionDestroyContext(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cp.SessionDestroy(sid)
+}
+
+func (cp contextProvider) SessionAllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cp.SessionAll()
+}
+
+// RequestProvider is a Provider keeping the sessions in the requests and responses
+// themselves instead of a backend, such as the cookie provider.
+// the Manager binds it to each request, the methods of the unbound provider
+// can not reach any session.
+type RequestProvider interface {
+	Provider
+	// WithRequest returns the provider bound to one request, its sessions are read
+	// from r and written to the header of w when they are released.
+	WithRequest(w http.ResponseWriter, r *http.Request) Provider
+}
+
+// CookieWriter adds the cookie name to the response, maxAge < 0 deletes it and 0 makes it
+// a browser session cookie.
+type CookieWriter func(name, value string, maxAge int)
+
+// CookieRequestProvider is a RequestProvider keeping the sessions in cookies, such as the
+// cookie provider. the Manager binds it with a CookieWriter building its cookies as the
+// session id cookie, with the same Path, Domain, Secure, SameSite and Partitioned.
+type CookieRequestProvider interface {
+	RequestProvider
+	// WithRequestCookies is WithRequest, the cookies are written by write.
+	WithRequestCookies(w http.ResponseWriter, r *http.Request, write CookieWriter) Provider
+}
+
+// providerFor returns the provider of the sessions of r, bound to w and r if it is a RequestProvider
+func (manager *Manager) providerFor(w http.ResponseWriter, r *http.Request) ContextProvider {
+	if cp, ok := unwrap(manager.provider).(CookieRequestProvider); ok {
+		return withContext(cp.WithRequestCookies(w, r, manager.cookieWriter(w, r)))
+	}
+	if rp, ok := unwrap(manager.provider).(RequestProvider); ok {
+		return withContext(rp.WithRequest(w, r))
+	}
+	return manager.provider
+}
+
+// inHeader reports whether the sessions are saved in the response header,
+// they must then be released before the header is written.
+func (manager *Manager) inHeader() bool {
+	_, ok := unwrap(manager.provider).(RequestProvider)
+	return ok
+}
+
+// ProviderFactory creates a new, uninitialized Provider.
+// it is called once per Manager so that every Manager owns its own provider instance.
+type ProviderFactory func() Provider
+
 // Register makes a session provide available by the provided name.
-// If Register is called twice with the same name or if driver is nil,
+// If Register is called twice with the same name or if factory is nil,
 // it panics.
-//func Register(name string, provide Provider) {
-//	if provide == nil {
-//		panic("session: Register provide is nil")
-//	}
-//	if _, dup := provides[name]; dup {
-//		panic("session: Register called twice for provider " + name)
-//	}
-//	provides[name] = provide
-//}
-
-// GetProvider
-func GetProvider(name string) (Provider, error) {
-	//provider, ok := provides[name]
-	//if !ok {
-	//	return nil, fmt.Errorf("session: unknown provide %q (forgotten import?)", name)
-	//}
-	//return provider, nil
-
-	switch name {
-	case "file":
-		return file.NewProvider(), nil
-	case "memory":
-		return memory.NewProvider(), nil
-	case "mysql":
-		return mysql.NewProvider(), nil
-	case "redis":
-		return redis.NewProvider(), nil
-	default:
-		return nil, fmt.Errorf("session: unknown provider %s", name)
+func Register(name string, factory ProviderFactory) {
+	providesLock.Lock()
+	defer providesLock.Unlock()
+	if factory == nil {
+		panic("session: Register provide is nil")
+	}
+	if _, dup := provides[name]; dup {
+		panic("session: Register called twice for provider " + name)
 	}
+	provides[name] = factory
+}
 
+// GetProvider create a new provider instance by the registered name.
+func GetProvider(name string) (Provider, error) {
+	providesLock.RLock()
+	factory, ok := provides[name]
+	providesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("session: unknown provide %q (forgotten import?)", name)
+	}
+	return factory(), nil
 }
 
 // ManagerConfig define the session config
 type ManagerConfig struct {
-	CookieName              string `json:"cookieName"`
-	EnableSetCookie         bool   `json:"enableSetCookie,omitempty"`
-	Gclifetime              int64  `json:"gclifetime"`
-	Maxlifetime             int64  `json:"maxLifetime"`
-	DisableHTTPOnly         bool   `json:"disableHTTPOnly"`
-	Secure                  bool   `json:"secure"`
-	CookieLifeTime          int    `json:"cookieLifeTime"`
-	ProviderConfig          string `json:"providerConfig"`
-	ProviderConfigMgr       string `json:"providerConfigMgr,omitempty"`
-	Domain                  string `json:"domain"`
-	SessionIDLength         int64  `json:"sessionIDLength"`
-	EnableSidInHTTPHeader   bool   `json:"EnableSidInHTTPHeader"`
-	SessionNameInHTTPHeader string `json:"SessionNameInHTTPHeader"`
-	EnableSidInURLQuery     bool   `json:"EnableSidInURLQuery"`
-	SessionIDPrefix         string `json:"sessionIDPrefix"`
+	CookieName               string   `json:"cookieName"`
+	EnableSetCookie          bool     `json:"enableSetCookie,omitempty"`
+	Gclifetime               int64    `json:"gclifetime"`
+	Maxlifetime              int64    `json:"maxLifetime"`
+	DisableHTTPOnly          bool     `json:"disableHTTPOnly"`
+	Secure                   bool     `json:"secure"`
+	CookieLifeTime           int      `json:"cookieLifeTime"`
+	ProviderConfig           string   `json:"providerConfig"`
+	ProviderConfigMgr        string   `json:"providerConfigMgr,omitempty"`
+	Domain                   string   `json:"domain"`
+	SessionIDLength          int64    `json:"sessionIDLength"`
+	EnableSidInHTTPHeader    bool     `json:"EnableSidInHTTPHeader"`
+	SessionNameInHTTPHeader  string   `json:"SessionNameInHTTPHeader"`
+	EnableSidInURLQuery      bool     `json:"EnableSidInURLQuery"`
+	SessionIDPrefix          string   `json:"sessionIDPrefix"`
+	LazySession              bool     `json:"lazySession"` // keep new sessions in memory and send no cookie until a value is set
+	Codec                    string   `json:"codec"`       // codec name of the persistent providers: gob (default), json or msgpack
+	Compression              string   `json:"compression"` // compressor name of the persistent providers: gzip, empty means no compression
+	CompressThreshold        int      `json:"compressThreshold"`
+	SidHashKey               string   `json:"sidHashKey"`               // store the sessions under the HMAC-SHA256 of their id by this key
+	IDGenerator              string   `json:"idGenerator"`              // built-in session id generator: hex (default), base64url, uuid, ulid or token
+	EnableSidInAuthorization bool     `json:"enableSidInAuthorization"` // read the session id from the Authorization header
+	AuthorizationScheme      string   `json:"authorizationScheme"`      // scheme of the Authorization header, defaults to Bearer
+	SidSources               []string `json:"sidSources"`               // order the session id is looked for, defaults to DefaultSidSources
+	CookiePath               string   `json:"cookiePath"`               // path of the session cookie, defaults to /
+	CookieSameSite           string   `json:"cookieSameSite"`           // SameSite of the session cookie: lax, strict or none, empty omits it
+	CookiePartitioned        bool     `json:"cookiePartitioned"`        // partition the session cookie by top-level site (CHIPS)
+	TrustedProxies           []string `json:"trustedProxies"`           // CIDRs or IPs of the proxies whose forwarded headers are honoured
+	ProxyHeader              string   `json:"proxyHeader"`              // forwarded header of the trusted proxies: X-Forwarded (default) or Forwarded
+	IdleTimeout              int64    `json:"idleTimeout"`              // seconds a session lives without being accessed, 0 for no limit
+	AbsoluteTimeout          int64    `json:"absoluteTimeout"`          // seconds a session lives since its creation, 0 for no limit
+	SlidingExpiration        bool     `json:"slidingExpiration"`        // the Manager refreshes the lifetime of the accessed sessions
+	RefreshFraction          float64  `json:"refreshFraction"`          // fraction of the lifetime, or of IdleTimeout, elapsed before recording an access again, defaults to DefaultRefreshFraction
 }
 
 // Manager contains Provider and its configuration.
 type Manager struct {
-	provider    Provider
-	providerMgr Provider
+	rejectedIDs uint64 // first for 64-bit alignment of atomic access
+
+	provider    ContextProvider
+	providerMgr ContextProvider
 	config      *ManagerConfig
+	idGenerator IDGenerator
+	logger      Logger
+	codec       codec.Codec
+	keyring     *codec.Keyring
+	compressor  codec.Compressor
+	sidSigner   *SidSigner
+	extractors  []Extractor
+
+	trustedProxies []*net.IPNet
+
+	releaseErrorHandler ReleaseErrorHandler
 }
 
 // NewManager Create new Manager with provider name and json config string.
@@ -121,23 +253,16 @@ type Manager struct {
 // 2. hashfunc  default sha1
 // 3. hashkey default beegosessionkey
 // 4. maxage default is none
+// the config is checked by ManagerConfig.Validate, a *ConfigError is returned if it is invalid.
 func NewManager(provideName string, cf *ManagerConfig) (*Manager, error) {
+	if err := cf.Validate(); err != nil {
+		return nil, err
+	}
 	if cf.Maxlifetime == 0 {
 		cf.Maxlifetime = cf.Gclifetime
 	}
-	if cf.EnableSidInHTTPHeader {
-		if cf.SessionNameInHTTPHeader == "" {
-			panic(errors.New("SessionNameInHTTPHeader is empty"))
-		}
-
-		strMimeHeader := textproto.CanonicalMIMEHeaderKey(cf.SessionNameInHTTPHeader)
-		if cf.SessionNameInHTTPHeader != strMimeHeader {
-			strErrMsg := "SessionNameInHTTPHeader (" + cf.SessionNameInHTTPHeader + ") has the wrong format, it should be like this : " + strMimeHeader
-			panic(errors.New(strErrMsg))
-		}
-	}
 	if cf.SessionIDLength == 0 {
-		cf.SessionIDLength = 16
+		cf.SessionIDLength = DefaultSessionIDLength
 	}
 
 	provider, err := GetProvider(provideName)
@@ -150,207 +275,435 @@ func NewManager(provideName string, cf *ManagerConfig) (*Manager, error) {
 		return nil, err
 	}
 
-	var providerMgr Provider
+	var providerMgr ContextProvider
 	if cf.ProviderConfigMgr != "" {
-		providerMgr, err = GetProvider(provideName)
+		pdrMgr, err := GetProvider(provideName)
 		if err != nil {
 			return nil, err
 		}
 
-		err = providerMgr.SessionInit(cf.Maxlifetime, cf.ProviderConfigMgr)
+		err = pdrMgr.SessionInit(cf.Maxlifetime, cf.ProviderConfigMgr)
 		if err != nil {
 			return nil, err
 		}
+		providerMgr = withContext(pdrMgr)
 	}
 
-	return &Manager{
-		provider:    provider,
+	if cf.Codec != "" {
+		c, err := codec.Lookup(cf.Codec)
+		if err != nil {
+			return nil, err
+		}
+		setCodec(provider, c)
+		if providerMgr != nil {
+			setCodec(providerMgr, c)
+		}
+	}
+	if cf.Compression != "" {
+		c, err := codec.LookupCompressor(cf.Compression)
+		if err != nil {
+			return nil, err
+		}
+		setCompression(provider, c, cf.CompressThreshold)
+		if providerMgr != nil {
+			setCompression(providerMgr, c, cf.CompressThreshold)
+		}
+	}
+
+	trustedProxies, err := parseTrustedProxies(cf.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	var idGenerator IDGenerator
+	if cf.IDGenerator != "" {
+		if idGenerator, err = NewIDGenerator(cf.IDGenerator, cf.SessionIDPrefix, int(cf.SessionIDLength)); err != nil {
+			return nil, err
+		}
+	}
+
+	manager := &Manager{
+		provider:    withContext(provider),
 		providerMgr: providerMgr,
 		config:      cf,
-	}, nil
+		idGenerator: idGenerator,
+		logger:      utils.SLogger,
+
+		trustedProxies: trustedProxies,
+
+		releaseErrorHandler: defaultReleaseErrorHandler,
+	}
+	if cf.SlidingExpiration {
+		setReleaseRefresh(manager.provider, false)
+	}
+	if key := manager.sidHashKey(); key != nil {
+		manager.provider = hashSids(manager.provider, key)
+	}
+	return manager, nil
+}
+
+func (manager *Manager) sidHashKey() []byte {
+	if manager.config.SidHashKey == "" {
+		return nil
+	}
+	return []byte(manager.config.SidHashKey)
 }
 
 // GetProvider return current manager's provider
 func (manager *Manager) GetProvider() Provider {
-	return manager.provider
+	return unwrap(manager.provider)
 }
 
 // getSid retrieves session identifier from HTTP Request.
-// First try to retrieve id by reading from cookie, session cookie name is configurable,
-// if not exist, then retrieve id from querying parameters.
+// the extractors are tried in order, the first one finding an id gives it and its source.
 //
 // error is not nil when there is anything wrong.
 // sid is empty when need to generate a new session id
 // otherwise return an valid session id.
-func (manager *Manager) getSid(r *http.Request) (string, error) {
-	cookie, errs := r.Cookie(manager.config.CookieName)
-	if errs != nil || cookie.Value == "" {
-		var sid string
-		if manager.config.EnableSidInURLQuery {
-			errs := r.ParseForm()
-			if errs != nil {
-				return "", errs
-			}
-
-			sid = r.FormValue(manager.config.CookieName)
+// an id whose signature or format is not valid is dropped, the later extractors are not
+// tried then, so the request gets a new session.
+func (manager *Manager) getSid(r *http.Request) (sid, source string, err error) {
+	for _, e := range manager.sidExtractors() {
+		sid, err = e.Extract(r)
+		if err != nil {
+			return "", "", err
 		}
-
-		// if not found in Cookie / param, then read it from request headers
-		if manager.config.EnableSidInHTTPHeader && sid == "" {
-			sids, isFound := r.Header[manager.config.SessionNameInHTTPHeader]
-			if isFound && len(sids) != 0 {
-				return sids[0], nil
+		if sid != "" {
+			if sid = manager.acceptSid(sid); sid == "" {
+				return "", "", nil
 			}
+			return sid, e.Source(), nil
 		}
-
-		return sid, nil
 	}
+	return "", "", nil
+}
 
-	// HTTP Request contains cookie for sessionid info.
-	return url.QueryUnescape(cookie.Value)
+// ExtractSid returns the session id of r and the source it is found in, such as
+// SidSourceCookie, without any provider call. sid is empty if r carries no valid id.
+func (manager *Manager) ExtractSid(r *http.Request) (sid, source string, err error) {
+	return manager.getSid(r)
 }
 
 // SessionStart generate or read the session id from http request.
 // if session id exists, return SessionStore with this id.
+// the provider calls are bounded by the request context.
+// with a RequestProvider the session must be released before the response header is written.
 func (manager *Manager) SessionStart(w http.ResponseWriter, r *http.Request) (session store.Store, err error) {
-	sid, errs := manager.getSid(r)
+	session, _, isNew, err := manager.sessionLoad(w, r)
+	if err != nil || !isNew {
+		return session, err
+	}
+
+	sid := session.SessionID()
+	cookie := manager.sessionCookie(r, sid)
+	if ls, ok := session.(*lazyStore); ok {
+		// the response header must not be written before the first Set
+		ls.onWrite = func() {
+			manager.setRequestSid(r, cookie, sid)
+			manager.setResponseSid(w, cookie, sid)
+		}
+		return
+	}
+	manager.setRequestSid(r, cookie, sid)
+	manager.setResponseSid(w, cookie, sid)
+	return
+}
+
+// sessionLoad read the session of the request, or create a new one if there is none.
+// isNew reports whether the session id still has to be sent to the client,
+// source is where the id of an existing session is found.
+func (manager *Manager) sessionLoad(w http.ResponseWriter, r *http.Request) (session store.Store, source string, isNew bool, err error) {
+	ctx := r.Context()
+	provider := manager.providerFor(w, r)
+	sid, source, errs := manager.getSid(r)
 	if errs != nil {
-		return nil, errs
+		return nil, "", false, errs
 	}
 
-	if sid != "" && manager.provider.SessionExist(sid) {
-		return manager.provider.SessionRead(sid)
+	if sid != "" && provider.SessionExistContext(ctx, sid) {
+		session, err = provider.SessionReadContext(ctx, sid)
+		if err != nil {
+			return nil, "", false, err
+		}
+		alive, err := manager.accessSession(session)
+		if err != nil || alive {
+			return session, source, false, err
+		}
+		// timed out, the session is replaced by a new one
+		if err = provider.SessionDestroyContext(ctx, sid); err != nil {
+			return nil, "", false, err
+		}
 	}
 
 	// Generate a new session
 	sid, errs = manager.sessionID()
 	if errs != nil {
-		return nil, errs
+		return nil, "", false, errs
 	}
 
-	session, err = manager.provider.SessionNew(sid, 0)
+	if manager.config.LazySession {
+		session = newLazyStore(provider, sid)
+	} else if session, err = provider.SessionNewContext(ctx, sid, 0); err != nil {
+		return nil, "", false, err
+	}
+	if err = manager.stampRequest(session, r); err != nil {
+		return nil, "", false, err
+	}
+	return session, "", true, nil
+}
+
+// signSid returns the value carrying sid to the client, signed if there is a SidSigner
+func (manager *Manager) signSid(sid string) string {
+	if manager.sidSigner == nil {
+		return sid
+	}
+	return manager.sidSigner.Sign(sid)
+}
+
+// verifySid returns the session id carried by value, it is empty if the signature is not valid
+func (manager *Manager) verifySid(value string) string {
+	if manager.sidSigner == nil {
+		return value
+	}
+	sid, _ := manager.sidSigner.Verify(value)
+	return sid
+}
+
+// checkSid reject sid before any provider call if it does not match the format of the
+// id generator, by its Validate(string) error method, as all built-in generators have.
+// the ids of a generator without it are only checked to be short printable ascii.
+// every rejected id is counted by RejectedIDs.
+func (manager *Manager) checkSid(sid string) error {
+	var err error
+	if v, ok := manager.generator().(interface{ Validate(string) error }); ok {
+		err = v.Validate(sid)
+	} else {
+		err = validateAny(sid)
+	}
 	if err != nil {
-		return nil, err
+		atomic.AddUint64(&manager.rejectedIDs, 1)
 	}
-	cookie := &http.Cookie{
-		Name:     manager.config.CookieName,
-		Value:    url.QueryEscape(sid),
-		Path:     "/",
-		HttpOnly: !manager.config.DisableHTTPOnly,
-		Secure:   manager.isSecure(r),
-		Domain:   manager.config.Domain,
+	return err
+}
+
+// acceptSid returns the session id carried by a value the client sent,
+// it is empty if the signature or the format is not valid.
+func (manager *Manager) acceptSid(value string) string {
+	sid := manager.verifySid(value)
+	if sid == "" {
+		atomic.AddUint64(&manager.rejectedIDs, 1)
+		return ""
 	}
-	if manager.config.CookieLifeTime > 0 {
-		cookie.MaxAge = manager.config.CookieLifeTime
-		cookie.Expires = time.Now().Add(time.Duration(manager.config.CookieLifeTime) * time.Second)
+	if manager.checkSid(sid) != nil {
+		return ""
 	}
-	if manager.config.EnableSetCookie {
-		http.SetCookie(w, cookie)
+	return sid
+}
+
+// RejectedIDs returns the number of session ids rejected so far for a bad
+// signature or format, a growing count may be a client probing for sessions.
+func (manager *Manager) RejectedIDs() uint64 {
+	return atomic.LoadUint64(&manager.rejectedIDs)
+}
+
+// setRequestSid make the rest of the request see sid as if the client had sent it,
+// cookie replaces the one of the same name the request may carry.
+func (manager *Manager) setRequestSid(r *http.Request, cookie *http.Cookie, sid string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != cookie.Name {
+			r.AddCookie(c)
+		}
 	}
 	r.AddCookie(cookie)
-
 	if manager.config.EnableSidInHTTPHeader {
-		r.Header.Set(manager.config.SessionNameInHTTPHeader, sid)
-		w.Header().Set(manager.config.SessionNameInHTTPHeader, sid)
+		r.Header.Set(manager.config.SessionNameInHTTPHeader, manager.signSid(sid))
 	}
+}
 
-	return
+// setResponseSid send sid to the client, it must be called before the response header is written.
+func (manager *Manager) setResponseSid(w http.ResponseWriter, cookie *http.Cookie, sid string) {
+	if manager.config.EnableSetCookie {
+		manager.writeCookie(w, cookie)
+	}
+	if manager.config.EnableSidInHTTPHeader {
+		w.Header().Set(manager.config.SessionNameInHTTPHeader, manager.signSid(sid))
+	}
 }
 
-// SessionDestroy Destroy session by its id in http request cookie.
+// SessionDestroy Destroy session by its id in http request, found as by SessionStart.
+// under Manager.Middleware the destroyed session is not saved again when the request ends.
 func (manager *Manager) SessionDestroy(w http.ResponseWriter, r *http.Request) {
+	sid, _, err := manager.getSid(r)
+	if err != nil {
+		manager.logger.Println(err)
+	}
 	if manager.config.EnableSidInHTTPHeader {
 		r.Header.Del(manager.config.SessionNameInHTTPHeader)
 		w.Header().Del(manager.config.SessionNameInHTTPHeader)
 	}
 
-	cookie, err := r.Cookie(manager.config.CookieName)
-	if err != nil || cookie.Value == "" {
-		return
+	if sid != "" {
+		if err := manager.providerFor(w, r).SessionDestroyContext(r.Context(), sid); err != nil {
+			manager.logger.Println(err)
+		}
+		manager.markDestroyed(r.Context(), sid)
 	}
+	if cookie, err := r.Cookie(manager.config.CookieName); err == nil && cookie.Value != "" && manager.config.EnableSetCookie {
+		manager.writeCookie(w, manager.expiredCookie(r))
+	}
+}
 
-	sid, _ := url.QueryUnescape(cookie.Value)
-	_ = manager.provider.SessionDestroy(sid)
-	if manager.config.EnableSetCookie {
-		expiration := time.Now()
-		cookie = &http.Cookie{Name: manager.config.CookieName,
-			Path:     "/",
-			HttpOnly: !manager.config.DisableHTTPOnly,
-			Expires:  expiration,
-			MaxAge:   -1}
-
-		http.SetCookie(w, cookie)
+// markDestroyed keep Manager.Middleware from saving its session again if sid is its id
+func (manager *Manager) markDestroyed(ctx context.Context, sid string) {
+	state := stateFromContext(ctx)
+	if state == nil {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.session.SessionID() == sid {
+		state.destroyed = true
 	}
 }
 
 // 生成token
 func (manager *Manager) TokenStart() (session store.Store, err error) {
+	return manager.TokenStartContext(context.Background())
+}
+
+// 生成token, 适配器调用受ctx控制
+func (manager *Manager) TokenStartContext(ctx context.Context) (session store.Store, err error) {
 	// Generate a new session
 	sid, errs := manager.sessionID()
 	if errs != nil {
 		return nil, errs
 	}
 
-	session, err = manager.provider.SessionNew(sid, 0)
+	session, err = manager.provider.SessionNewContext(ctx, sid, 0)
 	if err != nil {
 		return nil, err
 	}
+	if err = manager.stampNew(session); err != nil {
+		return nil, err
+	}
 
 	return
 }
 
 // 生成token(自定义时效)
 func (manager *Manager) TokenStartExpired(ttl time.Duration) (session store.Store, err error) {
+	return manager.TokenStartExpiredContext(context.Background(), ttl)
+}
+
+// 生成token(自定义时效), 适配器调用受ctx控制
+func (manager *Manager) TokenStartExpiredContext(ctx context.Context, ttl time.Duration) (session store.Store, err error) {
 	// Generate a new session
 	sid, errs := manager.sessionID()
 	if errs != nil {
 		return nil, errs
 	}
 
-	session, err = manager.provider.SessionNew(sid, int64(ttl.Seconds()))
+	session, err = manager.provider.SessionNewContext(ctx, sid, int64(ttl.Seconds()))
 	if err != nil {
 		return nil, err
 	}
+	if err = manager.stampNew(session); err != nil {
+		return nil, err
+	}
 
 	return
 }
 
+// TokenValue returns the token to hand out for the session id sid, such as the one of TokenStart,
+// it is signed if there is a SidSigner, so that it is accepted from the Authorization header
+// and the other sources, which verify the signature of every id.
+func (manager *Manager) TokenValue(sid string) string {
+	return manager.signSid(sid)
+}
+
 // 销毁token
 func (manager *Manager) TokenDestroy(sid string) error {
-	return manager.provider.SessionDestroy(sid)
+	return manager.TokenDestroyContext(context.Background(), sid)
+}
+
+// 销毁token, 适配器调用受ctx控制
+func (manager *Manager) TokenDestroyContext(ctx context.Context, sid string) error {
+	if err := manager.checkSid(sid); err != nil {
+		return err
+	}
+	return manager.provider.SessionDestroyContext(ctx, sid)
 }
 
 // GetSessionStore Get SessionStore by its id.
 func (manager *Manager) GetSessionStore(sid string) (sessions store.Store, err error) {
-	sessions, err = manager.provider.SessionRead(sid)
-	return
+	return manager.GetSessionStoreContext(context.Background(), sid)
+}
+
+// GetSessionStoreContext Get SessionStore by its id, the provider call is bounded by ctx.
+func (manager *Manager) GetSessionStoreContext(ctx context.Context, sid string) (sessions store.Store, err error) {
+	if err = manager.checkSid(sid); err != nil {
+		return nil, err
+	}
+	if sessions, err = manager.provider.SessionReadContext(ctx, sid); err != nil {
+		return nil, err
+	}
+	alive, err := manager.accessSession(sessions)
+	if err != nil || alive {
+		return sessions, err
+	}
+	// timed out, it is not found
+	if err = manager.provider.SessionDestroyContext(ctx, sid); err != nil {
+		return nil, err
+	}
+	return nil, ErrSessionTimeout
 }
 
 // 生成token与用户映射
 func (manager *Manager) TokenMgrCreate(userId, token string) (session store.Store, err error) {
-	session, err = manager.providerMgr.SessionNew(userId, 0)
+	return manager.TokenMgrCreateContext(context.Background(), userId, token)
+}
+
+// 生成token与用户映射, 适配器调用受ctx控制
+func (manager *Manager) TokenMgrCreateContext(ctx context.Context, userId, token string) (session store.Store, err error) {
+	session, err = manager.providerMgr.SessionNewContext(ctx, userId, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.Set("token", token)
+	err = session.Set("token", manager.BackendKey(token)) // never the plaintext token if the ids are hashed
 	if err != nil {
 		return nil, err
 	}
 
-	session.SessionRelease()
+	err = store.ReleaseContext(ctx, session)
+	if err != nil {
+		return nil, err
+	}
 	return
 }
+
+// 销毁用户对应的token及映射
 func (manager *Manager) MgrDestroyToken(userId string) (err error) {
-	session, err := manager.providerMgr.SessionRead(userId)
+	return manager.MgrDestroyTokenContext(context.Background(), userId)
+}
+
+// 销毁用户对应的token及映射, 适配器调用受ctx控制
+func (manager *Manager) MgrDestroyTokenContext(ctx context.Context, userId string) (err error) {
+	session, err := manager.providerMgr.SessionReadContext(ctx, userId)
 	if err != nil {
 		return
 	}
 
 	val := session.Get("token")
 	if val != nil {
-		manager.provider.SessionDestroy(val.(string)) // 销毁token
-		manager.providerMgr.SessionDestroy(userId)    // 销毁token与用户映射
+		if err := backend(manager.provider).SessionDestroyContext(ctx, val.(string)); err != nil { // 销毁token
+			manager.logger.Println(err)
+		}
+		if err := manager.providerMgr.SessionDestroyContext(ctx, userId); err != nil { // 销毁token与用户映射
+			manager.logger.Println(err)
+		}
 	}
 
 	return
@@ -363,50 +716,126 @@ func (manager *Manager) GC() {
 	time.AfterFunc(time.Duration(manager.config.Gclifetime)*time.Second, func() { manager.GC() })
 }
 
-// SessionRegenerateID Regenerate a session id for this SessionStore who's id is saving in http request.
+// SessionRegenerateID Regenerate a session id for this SessionStore who's id is saving in http request,
+// found as by SessionStart.
+// under Manager.Middleware the session of the request context is saved and replaced by the
+// regenerated one, which FromContext returns from then on and the Middleware releases.
 func (manager *Manager) SessionRegenerateID(w http.ResponseWriter, r *http.Request) (session store.Store) {
 	sid, err := manager.sessionID()
 	if err != nil {
 		return
 	}
-	cookie, err := r.Cookie(manager.config.CookieName)
-	if err != nil || cookie.Value == "" {
-		//delete old cookie
-		session, _ = manager.provider.SessionNew(sid, 0)
-		cookie = &http.Cookie{Name: manager.config.CookieName,
-			Value:    url.QueryEscape(sid),
-			Path:     "/",
-			HttpOnly: !manager.config.DisableHTTPOnly,
-			Secure:   manager.isSecure(r),
-			Domain:   manager.config.Domain,
+	oldsid, _, err := manager.getSid(r)
+	if err != nil {
+		manager.logger.Println(err)
+	}
+
+	state := stateFromContext(r.Context())
+	var currentSid string
+	if state != nil {
+		current, _, _ := state.get()
+		if currentSid = current.SessionID(); oldsid != "" && currentSid == oldsid {
+			// save the changes made so far, the provider moves them to sid
+			if err := store.ReleaseContext(r.Context(), current); err != nil {
+				manager.logger.Println(err)
+			}
 		}
-	} else {
-		oldsid, _ := url.QueryUnescape(cookie.Value)
-		session, _ = manager.provider.SessionRegenerate(oldsid, sid)
-		cookie.Value = url.QueryEscape(sid)
-		cookie.HttpOnly = true
-		cookie.Path = "/"
 	}
-	if manager.config.CookieLifeTime > 0 {
-		cookie.MaxAge = manager.config.CookieLifeTime
-		cookie.Expires = time.Now().Add(time.Duration(manager.config.CookieLifeTime) * time.Second)
+	if oldsid == "" {
+		session, err = manager.providerFor(w, r).SessionNewContext(r.Context(), sid, 0)
+		if err == nil {
+			err = manager.stampRequest(session, r)
+		}
+	} else {
+		session, err = manager.providerFor(w, r).SessionRegenerateContext(r.Context(), oldsid, sid)
+		if err == nil {
+			err = manager.regenerated(session)
+		}
 	}
-	if manager.config.EnableSetCookie {
-		http.SetCookie(w, cookie)
+	if err != nil {
+		manager.logger.Println(err)
 	}
-	r.AddCookie(cookie)
-
-	if manager.config.EnableSidInHTTPHeader {
-		r.Header.Set(manager.config.SessionNameInHTTPHeader, sid)
-		w.Header().Set(manager.config.SessionNameInHTTPHeader, sid)
+	if state != nil && session != nil && (oldsid == "" || currentSid == oldsid) {
+		// the Middleware must never write the old id back
+		state.lock.Lock()
+		state.session, state.regenerated = session, true
+		state.lock.Unlock()
 	}
-
+	cookie := manager.sessionCookie(r, sid)
+	manager.setResponseSid(w, cookie, sid)
+	manager.setRequestSid(r, cookie, sid)
 	return
 }
 
 // GetActiveSession Get all active sessions id.
+// if the ids are hashed, they are the backend keys and can not be used as session ids.
 func (manager *Manager) GetActiveSession() ([]string, error) {
-	return manager.provider.SessionAll()
+	return manager.provider.SessionAllContext(context.Background())
+}
+
+// Reencrypt rewrites the stored sessions whose payload is stale, those sealed by
+// an old key of the keyring, in plaintext, or written by another codec or schema version.
+// it reads every session, so run it in the background after a key rotation,
+// and remove the old key from the keyring only once it is done.
+// the sessions are read without refreshing them if the provider has a
+// SessionPeek(sid string) (store.Store, error) method, as memory and file have, the reads of
+// redis and mysql never refresh, and the sessions past IdleTimeout or AbsoluteTimeout are skipped,
+// so only the rewritten sessions get their lifetime refreshed.
+// it returns the number of sessions rewritten.
+func (manager *Manager) Reencrypt(ctx context.Context) (int, error) {
+	n, err := manager.reencrypt(ctx, backend(manager.provider))
+	if err != nil || manager.providerMgr == nil {
+		return n, err
+	}
+	m, err := manager.reencrypt(ctx, manager.providerMgr)
+	return n + m, err
+}
+
+func (manager *Manager) reencrypt(ctx context.Context, provider ContextProvider) (int, error) {
+	sids, err := provider.SessionAllContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	read := func(sid string) (store.Store, error) {
+		return provider.SessionReadContext(ctx, sid)
+	}
+	if p, ok := unwrap(provider).(interface {
+		SessionPeek(sid string) (store.Store, error)
+	}); ok {
+		read = p.SessionPeek
+	}
+
+	n := 0
+	for _, sid := range sids {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		st, err := read(sid)
+		if err != nil || st == nil {
+			if err != nil && provider.SessionExistContext(ctx, sid) {
+				manager.logger.Println(err) // can not be decoded, such as sealed by a removed key
+			}
+			continue // expired since it was listed
+		}
+		if manager.timedOut(st, time.Now().Unix()) {
+			continue
+		}
+		if d, ok := st.(interface{ Dirty() bool }); !ok || !d.Dirty() {
+			continue
+		}
+		if err := store.ReleaseContext(ctx, st); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// SetSidSigner sign the session ids sent to the clients by s, ids without a valid
+// signature are then dropped before any provider call, nil turns signing off.
+func (manager *Manager) SetSidSigner(s *SidSigner) {
+	manager.sidSigner = s
 }
 
 // SetSecure Set cookie with https.
@@ -416,15 +845,19 @@ func (manager *Manager) SetSecure(secure bool) {
 
 // Generate a session id
 func (manager *Manager) sessionID() (string, error) {
-	b := make([]byte, manager.config.SessionIDLength)
-	n, err := rand.Read(b)
-	if n != len(b) || err != nil {
-		return "", errors.New("could not successfully read from the system CSPRNG")
+	return manager.generator().NewID()
+}
+
+// generator returns the id generator, it defaults to HexIDGenerator by the config
+func (manager *Manager) generator() IDGenerator {
+	if manager.idGenerator != nil {
+		return manager.idGenerator
 	}
-	return manager.config.SessionIDPrefix + hex.EncodeToString(b), nil
+	return HexIDGenerator{Prefix: manager.config.SessionIDPrefix, Length: int(manager.config.SessionIDLength)}
 }
 
-// Set cookie with https.
+// isSecure reports whether the cookie should be Secure: the request is https, directly
+// or as told by a trusted proxy.
 func (manager *Manager) isSecure(req *http.Request) bool {
 	if !manager.config.Secure {
 		return false
@@ -432,8 +865,8 @@ func (manager *Manager) isSecure(req *http.Request) bool {
 	if req.URL.Scheme != "" {
 		return req.URL.Scheme == "https"
 	}
-	if req.TLS == nil {
-		return false
+	if req.TLS != nil {
+		return true
 	}
-	return true
+	return manager.forwardedProto(req) == "https"
 }
@@ -0,0 +1,94 @@
+package session_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/file"
+	"github.com/misu99/session/store"
+)
+
+func TestReencryptDoesNotRefresh(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager, err := session.New(file.NewProviderWithPath(dir), session.WithGCLifetime(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Set("user", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SessionRelease(); err != nil {
+		t.Fatal(err)
+	}
+
+	sid := st.SessionID()
+	name := filepath.Join(dir, sid[:1], sid[1:2], sid)
+	old := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	n, err := manager.Reencrypt(context.Background())
+	if err != nil || n != 0 {
+		t.Fatalf("Reencrypt = %d, %v", n, err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("Reencrypt refreshed an up to date session to %v", info.ModTime())
+	}
+}
+
+func TestMarkDirtySavesInPlaceChanges(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager, err := session.New(file.NewProviderWithPath(dir), session.WithGCLifetime(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := st.SessionID()
+	if err := st.Set("cart", map[string]int{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SessionRelease(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mark := range []bool{false, true} {
+		if st, err = manager.GetSessionStore(sid); err != nil {
+			t.Fatal(err)
+		}
+		st.Get("cart").(map[string]int)["apple"]++
+		if mark {
+			store.MarkDirty(st)
+		}
+		if err := st.SessionRelease(); err != nil {
+			t.Fatal(err)
+		}
+
+		if st, err = manager.GetSessionStore(sid); err != nil {
+			t.Fatal(err)
+		}
+		n := st.Get("cart").(map[string]int)["apple"]
+		if mark && n != 1 {
+			t.Errorf("marked change: apple = %d, want 1", n)
+		}
+		if !mark && n != 0 {
+			t.Errorf("unmarked change: apple = %d, want it not saved", n)
+		}
+	}
+}
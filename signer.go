@@ -0,0 +1,113 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MinSidSignerKeyLength is the minimal length of a SidSigner key, in bytes
+const MinSidSignerKeyLength = 32
+
+// SidSigner signs the session ids sent to the clients by HMAC-SHA256, so that
+// forged ids are rejected before the provider is called.
+// the primary key signs, every key verifies, so that a key can be rotated
+// while the ids signed by the old one are still accepted.
+//
+// a signed id is: sid "." base64url(key id, mac)
+type SidSigner struct {
+	lock    sync.RWMutex
+	primary byte
+	keys    map[byte][]byte
+}
+
+// NewSidSigner create a signer with the primary key, key must be at least MinSidSignerKeyLength bytes
+func NewSidSigner(id byte, key []byte) (*SidSigner, error) {
+	s := &SidSigner{keys: make(map[byte][]byte)}
+	if err := s.Add(id, key); err != nil {
+		return nil, err
+	}
+	s.primary = id
+	return s, nil
+}
+
+// Add add a key which only verifies, such as the previous primary key.
+func (s *SidSigner) Add(id byte, key []byte) error {
+	if len(key) < MinSidSignerKeyLength {
+		return fmt.Errorf("session: sid signer key must be at least %d bytes, got %d", MinSidSignerKeyLength, len(key))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, dup := s.keys[id]; dup {
+		return fmt.Errorf("session: sid signer key id %d already exists", id)
+	}
+	s.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// Rotate add a new key and make it the primary key, the old keys still verify.
+func (s *SidSigner) Rotate(id byte, key []byte) error {
+	if err := s.Add(id, key); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.primary = id
+	return nil
+}
+
+// Remove remove a key once no client holds an id signed by it, the primary key can not be removed.
+func (s *SidSigner) Remove(id byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id == s.primary {
+		return errors.New("session: the primary sid signer key can not be removed")
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+// Sign returns sid signed by the primary key
+func (s *SidSigner) Sign(sid string) string {
+	s.lock.RLock()
+	id, key := s.primary, s.keys[s.primary]
+	s.lock.RUnlock()
+
+	b := append([]byte{id}, mac(key, sid)...)
+	return sid + "." + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Verify returns the session id of a value made by Sign, ok is false if the
+// signature is malformed, made by an unknown key, or does not match.
+func (s *SidSigner) Verify(value string) (sid string, ok bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i <= 0 {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || len(b) != 1+sha256.Size {
+		return "", false
+	}
+
+	s.lock.RLock()
+	key, found := s.keys[b[0]]
+	s.lock.RUnlock()
+	if !found {
+		return "", false
+	}
+	sid = value[:i]
+	if !hmac.Equal(b[1:], mac(key, sid)) {
+		return "", false
+	}
+	return sid, true
+}
+
+func mac(key []byte, sid string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(sid))
+	return h.Sum(nil)
+}
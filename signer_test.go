@@ -0,0 +1,44 @@
+package session_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/memory"
+)
+
+func TestSignedBearerToken(t *testing.T) {
+	signer, err := session.NewSidSigner(1, bytes.Repeat([]byte("k"), session.MinSidSignerKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithSidSigner(signer),
+		session.WithSessionIDInAuthorization(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+manager.TokenValue(st.SessionID()))
+	sid, source, err := manager.ExtractSid(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid != st.SessionID() || source != session.SidSourceAuthorization {
+		t.Errorf("ExtractSid = %q, %q, want %q, %q", sid, source, st.SessionID(), session.SidSourceAuthorization)
+	}
+
+	r.Header.Set("Authorization", "Bearer "+st.SessionID())
+	if sid, _, _ = manager.ExtractSid(r); sid != "" {
+		t.Errorf("ExtractSid accepted the unsigned token %q", sid)
+	}
+}
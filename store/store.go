@@ -1,5 +1,10 @@
 package store
 
+import (
+	"context"
+	"strings"
+)
+
 // Store contains all data for one session process with specific id.
 type Store interface {
 	Set(key, value interface{}) error //set session value
@@ -7,6 +12,59 @@ type Store interface {
 	Delete(key interface{}) error     //delete session value
 	SessionID() string                //back current sessionID
 	SessionDelay()                    //session延期
-	SessionRelease()                  //release the resource & save data to provider & return the data
+	SessionRelease() error            //release the resource & save data to provider & return the error
 	Flush() error                     //delete all data
 }
+
+// ContextStore is a Store whose backend calls can be cancelled by a context.
+type ContextStore interface {
+	Store
+	SessionDelayContext(ctx context.Context)         //session延期
+	SessionReleaseContext(ctx context.Context) error //release the resource & save data to provider
+}
+
+// DelayContext extend the session by ctx if st supports it, otherwise it calls SessionDelay.
+func DelayContext(ctx context.Context, st Store) {
+	if cs, ok := st.(ContextStore); ok {
+		cs.SessionDelayContext(ctx)
+		return
+	}
+	st.SessionDelay()
+}
+
+// ReleaseContext save the session by ctx if st supports it, otherwise it calls SessionRelease.
+func ReleaseContext(ctx context.Context, st Store) error {
+	if cs, ok := st.(ContextStore); ok {
+		return cs.SessionReleaseContext(ctx)
+	}
+	return st.SessionRelease()
+}
+
+// MarkDirty make st written on release if it tracks its changes, as the built-in stores do.
+// Set marks a store already, a value changed in place after Get, such as a map or a
+// pointer, is only saved once the store is marked.
+func MarkDirty(st Store) {
+	if d, ok := st.(interface{ MarkDirty() }); ok {
+		d.MarkDirty()
+	}
+}
+
+// MetadataPrefix is the key prefix of the values the manager keeps for itself, Flush and Delete never remove them.
+const MetadataPrefix = "__session_"
+
+// IsMetadata reports whether key is one of the manager's metadata keys.
+func IsMetadata(key interface{}) bool {
+	s, ok := key.(string)
+	return ok && strings.HasPrefix(s, MetadataPrefix)
+}
+
+// KeepMetadata return a new map holding only the metadata of values.
+func KeepMetadata(values map[interface{}]interface{}) map[interface{}]interface{} {
+	kept := make(map[interface{}]interface{})
+	for k, v := range values {
+		if IsMetadata(k) {
+			kept[k] = v
+		}
+	}
+	return kept
+}
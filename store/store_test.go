@@ -0,0 +1,49 @@
+package store
+
+import "testing"
+
+func TestIsMetadata(t *testing.T) {
+	for key, want := range map[interface{}]bool{
+		MetadataPrefix + "created_at": true,
+		"__session":                   false,
+		"user":                        false,
+		1:                             false,
+	} {
+		if got := IsMetadata(key); got != want {
+			t.Errorf("IsMetadata(%v) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestKeepMetadata(t *testing.T) {
+	values := map[interface{}]interface{}{
+		MetadataPrefix + "created_at": int64(1),
+		"user":                        "alice",
+		2:                             "two",
+	}
+	kept := KeepMetadata(values)
+	if len(kept) != 1 || kept[MetadataPrefix+"created_at"] != int64(1) {
+		t.Fatalf("KeepMetadata = %v", kept)
+	}
+	if len(values) != 3 {
+		t.Fatalf("KeepMetadata changed its argument: %v", values)
+	}
+}
+
+type markedStore struct {
+	Store
+	marked bool
+}
+
+func (st *markedStore) MarkDirty() {
+	st.marked = true
+}
+
+func TestMarkDirty(t *testing.T) {
+	st := &markedStore{}
+	MarkDirty(st)
+	if !st.marked {
+		t.Error("MarkDirty did not mark the store")
+	}
+	MarkDirty(st.Store) // a store without MarkDirty is left as is
+}
@@ -0,0 +1,187 @@
+package session
+
+import (
+	"errors"
+	"github.com/misu99/session/store"
+	"net/http"
+	"time"
+)
+
+// keys of the session metadata kept with the values when a timeout or the sliding
+// expiration is set, the times are unix timestamps in seconds. Flush and Delete keep them.
+const (
+	CreatedAtKey  = store.MetadataPrefix + "created_at"
+	LastAccessKey = store.MetadataPrefix + "last_access"
+	ClientIPKey   = store.MetadataPrefix + "client_ip" // ClientIP of the request creating the session
+)
+
+// ErrSessionTimeout is returned by GetSessionStore for a session past IdleTimeout or AbsoluteTimeout
+var ErrSessionTimeout = errors.New("session: the sid's session not found, it has timed out")
+
+// DefaultRefreshFraction is the fraction of the lifetime elapsed before a sliding session is refreshed
+const DefaultRefreshFraction = 0.1
+
+// tracksAccess reports whether the Manager keeps the session metadata, for IdleTimeout,
+// AbsoluteTimeout or SlidingExpiration
+func (manager *Manager) tracksAccess() bool {
+	cf := manager.config
+	return cf.IdleTimeout > 0 || cf.AbsoluteTimeout > 0 || cf.SlidingExpiration
+}
+
+// accessInterval returns the seconds between two records of LastAccessKey in st, 0 if the
+// access is not recorded as neither IdleTimeout nor SlidingExpiration is set.
+// recording an access writes the session, so it is done once the refresh fraction of IdleTimeout
+// has elapsed, with SlidingExpiration it also refreshes the lifetime and the fraction is the one
+// of the lifetime, or of IdleTimeout if shorter. an idle session may thus time out up to that
+// fraction of IdleTimeout early.
+// the lifetime is the one of st if it has a Lifetime() int64 method, as the built-in stores.
+func (manager *Manager) accessInterval(st store.Store) int64 {
+	cf := manager.config
+	if !cf.SlidingExpiration && cf.IdleTimeout <= 0 {
+		return 0
+	}
+	fraction := cf.RefreshFraction
+	if fraction == 0 {
+		fraction = DefaultRefreshFraction
+	}
+	lifetime := cf.IdleTimeout
+	if cf.SlidingExpiration {
+		lifetime = cf.Maxlifetime
+		if l, ok := st.(interface{ Lifetime() int64 }); ok && l.Lifetime() > 0 {
+			lifetime = l.Lifetime()
+		}
+		if cf.IdleTimeout > 0 && cf.IdleTimeout < lifetime {
+			lifetime = cf.IdleTimeout
+		}
+	}
+	if interval := int64(float64(lifetime) * fraction); interval > 1 {
+		return interval
+	}
+	return 1
+}
+
+// stampNew record the creation of a new session.
+func (manager *Manager) stampNew(st store.Store) error {
+	if !manager.tracksAccess() {
+		return nil
+	}
+	now := time.Now().Unix()
+	if ls, ok := st.(*lazyStore); ok {
+		// metadata alone must not make a lazy session persistent
+		ls.setMeta(CreatedAtKey, now)
+		if manager.accessInterval(st) > 0 {
+			ls.setMeta(LastAccessKey, now)
+		}
+		return nil
+	}
+	if err := st.Set(CreatedAtKey, now); err != nil {
+		return err
+	}
+	if manager.accessInterval(st) == 0 {
+		return nil
+	}
+	return st.Set(LastAccessKey, now)
+}
+
+// accessSession check st against IdleTimeout and AbsoluteTimeout and record the access
+// every accessInterval. it returns false if st has timed out, such a session must be
+// treated as non-existent.
+// a session stored without metadata, before the timeouts were set or after a Flush,
+// is taken as created now.
+func (manager *Manager) accessSession(st store.Store) (alive bool, err error) {
+	if !manager.tracksAccess() {
+		return true, nil
+	}
+	now := time.Now().Unix()
+	if _, ok := unixValue(st.Get(CreatedAtKey)); !ok {
+		return true, manager.stampNew(st)
+	}
+	if manager.timedOut(st, now) {
+		return false, nil
+	}
+	accessed := manager.lastAccess(st)
+	if interval := manager.accessInterval(st); interval > 0 && now-accessed >= interval {
+		err = st.Set(LastAccessKey, now)
+	}
+	return true, err
+}
+
+// stampRequest record the creation of a new session by r, with the ClientIP of r.
+// the ClientIP is recorded whether the timeouts are set or not.
+func (manager *Manager) stampRequest(st store.Store, r *http.Request) error {
+	if err := manager.stampNew(st); err != nil {
+		return err
+	}
+	if ls, ok := st.(*lazyStore); ok {
+		ls.setMeta(ClientIPKey, manager.ClientIP(r))
+		return nil
+	}
+	return st.Set(ClientIPKey, manager.ClientIP(r))
+}
+
+// timedOut reports whether st is past IdleTimeout or AbsoluteTimeout at now, without recording
+// the access. a session without metadata has not timed out.
+func (manager *Manager) timedOut(st store.Store, now int64) bool {
+	created, ok := unixValue(st.Get(CreatedAtKey))
+	if !ok {
+		return false
+	}
+	if abs := manager.config.AbsoluteTimeout; abs > 0 && now-created >= abs {
+		return true
+	}
+	idle := manager.config.IdleTimeout
+	return idle > 0 && now-manager.lastAccess(st) >= idle
+}
+
+// lastAccess returns the last access recorded in st, its creation if there is none
+func (manager *Manager) lastAccess(st store.Store) int64 {
+	if accessed, ok := unixValue(st.Get(LastAccessKey)); ok {
+		return accessed
+	}
+	created, _ := unixValue(st.Get(CreatedAtKey))
+	return created
+}
+
+// regenerated check a session whose id has been regenerated, it keeps its creation time
+// so that regenerating does not extend AbsoluteTimeout, a timed out one is emptied.
+func (manager *Manager) regenerated(st store.Store) error {
+	alive, err := manager.accessSession(st)
+	if err != nil || alive {
+		return err
+	}
+	if err = st.Flush(); err != nil {
+		return err
+	}
+	return manager.stampNew(st)
+}
+
+// unixValue returns a timestamp of the metadata, whichever number type the codec decoded it to
+func unixValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	case uint:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	case float32:
+		return int64(n), true
+	}
+	return 0, false
+}
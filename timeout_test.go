@@ -0,0 +1,152 @@
+package session_test
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/misu99/session"
+	"github.com/misu99/session/provider/file"
+	"github.com/misu99/session/provider/memory"
+)
+
+func TestFlushKeepsMetadata(t *testing.T) {
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithTimeouts(0, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := st.Get(session.CreatedAtKey)
+	if created == nil {
+		t.Fatal("new session has no CreatedAtKey")
+	}
+	if err := st.Set("user", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete(session.CreatedAtKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Get("user") != nil {
+		t.Error("Flush kept a user value")
+	}
+	if got := st.Get(session.CreatedAtKey); got != created {
+		t.Errorf("CreatedAtKey = %v after Flush and Delete, want %v", got, created)
+	}
+}
+
+func TestAbsoluteTimeoutOnlyKeepsNoLastAccess(t *testing.T) {
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithTimeouts(0, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Get(session.LastAccessKey) != nil {
+		t.Error("new session records LastAccessKey without IdleTimeout")
+	}
+	if st, err = manager.GetSessionStore(st.SessionID()); err != nil {
+		t.Fatal(err)
+	}
+	if st.Get(session.LastAccessKey) != nil {
+		t.Error("GetSessionStore records LastAccessKey without IdleTimeout")
+	}
+}
+
+func TestGetSessionStoreTimedOut(t *testing.T) {
+	manager, err := session.New(memory.NewProvider(),
+		session.WithGCLifetime(time.Hour),
+		session.WithTimeouts(time.Minute, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := manager.TokenStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := st.SessionID()
+	if err := st.Set(session.LastAccessKey, time.Now().Add(-2*time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SessionRelease(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.GetSessionStore(sid); !errors.Is(err, session.ErrSessionTimeout) {
+		t.Fatalf("GetSessionStore of an idle session: err = %v, want ErrSessionTimeout", err)
+	}
+	if _, err = manager.GetSessionStore(sid); err == nil {
+		t.Fatal("the timed out session is still stored")
+	}
+}
+
+func TestSlidingExpirationDebounce(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager, err := session.New(file.NewProviderWithPath(dir),
+		session.WithGCLifetime(time.Hour),
+		session.WithMaxLifetime(time.Hour),
+		session.WithSlidingExpiration(0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ago     time.Duration
+		refresh bool
+	}{
+		{"inside the interval", time.Minute, false},
+		{"past the interval", 10 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		st, err := manager.TokenStart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessed := time.Now().Add(-tt.ago).Truncate(time.Second)
+		st.Set(session.LastAccessKey, accessed.Unix())
+		if err := st.SessionRelease(); err != nil {
+			t.Fatal(err)
+		}
+		sid := st.SessionID()
+		name := filepath.Join(dir, sid[:1], sid[1:2], sid)
+		if err := os.Chtimes(name, accessed, accessed); err != nil {
+			t.Fatal(err)
+		}
+
+		var last interface{}
+		serve(manager, func(w http.ResponseWriter, r *http.Request) {
+			last = session.FromContext(r.Context()).Get(session.LastAccessKey)
+		}, &http.Cookie{Name: session.DefaultCookieName, Value: sid})
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refreshed := !info.ModTime().Equal(accessed); refreshed != tt.refresh {
+			t.Errorf("%s: file refreshed %v, want %v", tt.name, refreshed, tt.refresh)
+		}
+		if updated := last != accessed.Unix(); updated != tt.refresh {
+			t.Errorf("%s: LastAccessKey = %v, was %d", tt.name, last, accessed.Unix())
+		}
+		if st, err = manager.GetSessionStore(sid); err != nil {
+			t.Fatal(err)
+		}
+		if stored := st.Get(session.LastAccessKey) != accessed.Unix(); stored != tt.refresh {
+			t.Errorf("%s: stored LastAccessKey = %v, was %d", tt.name, st.Get(session.LastAccessKey), accessed.Unix())
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package session
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strings"
+)
+
+// DefaultTokenPrefix is the type prefix of TokenIDGenerator when Prefix is empty
+const DefaultTokenPrefix = "sess"
+
+// tokenChecksumLength is the number of base62 characters of the crc32 checksum
+const tokenChecksumLength = 6
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ErrTokenFormat is returned for tokens which are not made by TokenIDGenerator
+var ErrTokenFormat = errors.New("session: malformed token")
+
+// TokenIDGenerator generates self-identifying tokens:
+//
+//	prefix "_" base62(random) base62(crc32)
+//
+// such as sess_3kTMd7f0xYq2Vb9LpE1wZa0Jm4Xc. the prefix tells what a leaked token is,
+// the checksum lets scanners and ValidateTokenFormat reject random strings offline.
+type TokenIDGenerator struct {
+	Prefix string // type prefix, defaults to DefaultTokenPrefix, it must not contain "_"
+	Length int    // number of random bytes of entropy, zero means DefaultSessionIDLength, at least MinSessionIDLength
+}
+
+// NewID implement IDGenerator
+func (g TokenIDGenerator) NewID() (string, error) {
+	length, err := idLength(g.Length)
+	if err != nil {
+		return "", err
+	}
+	n := tokenBodyLength(length)
+	body := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(body) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", errors.New("could not successfully read from the system CSPRNG")
+		}
+		for _, b := range buf {
+			if b < 248 { // 4*62, keeps the characters uniform
+				body = append(body, base62[b%62])
+				if len(body) == n {
+					break
+				}
+			}
+		}
+	}
+
+	token := g.prefix() + "_" + string(body)
+	return token + tokenChecksum(token), nil
+}
+
+// Validate check sid is a well formed token of g, with the random part of g.Length
+func (g TokenIDGenerator) Validate(sid string) error {
+	length, err := idLength(g.Length)
+	if err != nil {
+		return err
+	}
+	if err := ValidateTokenFormat(sid, g.prefix()); err != nil {
+		return err
+	}
+	want := tokenBodyLength(length)
+	if n := len(sid) - len(g.prefix()) - 1 - tokenChecksumLength; n != want {
+		return fmt.Errorf("%w: random part is %d characters, want %d", ErrTokenFormat, n, want)
+	}
+	return nil
+}
+
+func (g TokenIDGenerator) checkLength() error {
+	_, err := idLength(g.Length)
+	return err
+}
+
+func (g TokenIDGenerator) prefix() string {
+	if g.Prefix == "" {
+		return DefaultTokenPrefix
+	}
+	return g.Prefix
+}
+
+// ValidateTokenFormat check token is made by a TokenIDGenerator with the type prefix,
+// by its characters, checksum and a random part of at least MinSessionIDLength bytes,
+// without any provider lookup. TokenIDGenerator.Validate checks the exact length.
+func ValidateTokenFormat(token, prefix string) error {
+	if prefix == "" {
+		prefix = DefaultTokenPrefix
+	}
+	if !strings.HasPrefix(token, prefix+"_") {
+		return fmt.Errorf("%w: prefix is not %s", ErrTokenFormat, prefix)
+	}
+	rest := token[len(prefix)+1:]
+	if len(rest)-tokenChecksumLength < tokenBodyLength(MinSessionIDLength) {
+		return fmt.Errorf("%w: too short", ErrTokenFormat)
+	}
+	for i := 0; i < len(rest); i++ {
+		if strings.IndexByte(base62, rest[i]) < 0 {
+			return fmt.Errorf("%w: invalid character %q", ErrTokenFormat, rest[i])
+		}
+	}
+	split := len(token) - tokenChecksumLength
+	if tokenChecksum(token[:split]) != token[split:] {
+		return fmt.Errorf("%w: checksum mismatch", ErrTokenFormat)
+	}
+	return nil
+}
+
+// tokenBodyLength returns the number of base62 characters carrying length random bytes
+func tokenBodyLength(length int) int {
+	return int(math.Ceil(float64(length*8) / math.Log2(62)))
+}
+
+// tokenChecksum returns the crc32 of s in tokenChecksumLength base62 characters
+func tokenChecksum(s string) string {
+	sum := crc32.ChecksumIEEE([]byte(s))
+	b := make([]byte, tokenChecksumLength)
+	for i := tokenChecksumLength - 1; i >= 0; i-- {
+		b[i] = base62[sum%62]
+		sum /= 62
+	}
+	return string(b)
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTokenIDGenerator(t *testing.T) {
+	for _, g := range []TokenIDGenerator{{}, {Prefix: "api", Length: 24}} {
+		seen := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			token, err := g.NewID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[token] {
+				t.Fatalf("%#v made %q twice", g, token)
+			}
+			seen[token] = true
+			if err := g.Validate(token); err != nil {
+				t.Errorf("%#v: Validate(%q): %v", g, token, err)
+			}
+			if err := ValidateTokenFormat(token, g.Prefix); err != nil {
+				t.Errorf("ValidateTokenFormat(%q): %v", token, err)
+			}
+		}
+	}
+	if _, err := (TokenIDGenerator{Length: 4}).NewID(); err == nil {
+		t.Error("TokenIDGenerator with 4 bytes made a token")
+	}
+}
+
+func TestValidateTokenFormat(t *testing.T) {
+	token, _ := TokenIDGenerator{}.NewID()
+	last := token[len(token)-1]
+	flipped := byte('A')
+	if last == 'A' {
+		flipped = 'B'
+	}
+	tests := []string{
+		"",
+		"sess_",
+		"sess_abc",
+		"other" + token[len(DefaultTokenPrefix):],
+		token[:len(token)-1] + string(flipped),
+		strings.Replace(token, "_", "_-", 1),
+		token[:10] + "!" + token[11:],
+	}
+	for _, bad := range tests {
+		if err := ValidateTokenFormat(bad, ""); !errors.Is(err, ErrTokenFormat) {
+			t.Errorf("ValidateTokenFormat(%q) = %v, want ErrTokenFormat", bad, err)
+		}
+	}
+
+	// short random parts with a valid checksum
+	short := "sess_abc"
+	short += tokenChecksum(short)
+	if err := ValidateTokenFormat(short, ""); !errors.Is(err, ErrTokenFormat) {
+		t.Errorf("ValidateTokenFormat(%q) = %v, want ErrTokenFormat", short, err)
+	}
+	if err := (TokenIDGenerator{}).Validate(short); !errors.Is(err, ErrTokenFormat) {
+		t.Errorf("Validate(%q) = %v, want ErrTokenFormat", short, err)
+	}
+	if err := (TokenIDGenerator{Length: 24}).Validate(token); !errors.Is(err, ErrTokenFormat) {
+		t.Errorf("Validate of a token shorter than Length = %v, want ErrTokenFormat", err)
+	}
+}
+
+func TestTokenChecksum(t *testing.T) {
+	// crc32("sess_a") is 0x450defdf
+	if got := tokenChecksum("sess_a"); got != "1GP7Vf" {
+		t.Errorf("tokenChecksum(sess_a) = %s, want 1GP7Vf", got)
+	}
+}